@@ -0,0 +1,662 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"bakonpancakz/stickerboard/env"
+)
+
+// Arguments for a Command, sent as JSON when talking to a running instance
+type Request struct {
+	ID            int    `json:"id,omitempty"`
+	CIDR          string `json:"cidr,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+	Hash          string `json:"hash,omitempty"`
+	Path          string `json:"path,omitempty"`
+	Replace       bool   `json:"replace,omitempty"`
+	Moderate      bool   `json:"moderate,omitempty"`
+	RemoveOrphans bool   `json:"remove_orphans,omitempty"`
+	Quarantine    bool   `json:"quarantine,omitempty"`
+	Status        bool   `json:"status,omitempty"`
+}
+
+type command struct {
+	Usage    string                                            // Command Arguments
+	Help     string                                            // Command Description
+	Model    bool                                              // Load the Model when run offline?
+	Modifies bool                                              // Save the Database when run offline?
+	Render   bool                                              // Render the Stickerboard if the command modified it on a live instance?
+	Parse    func(args []string) (Request, error)              // Parse Command Line Arguments
+	Run      func(ctx context.Context, r Request) (any, error) // Run Command
+	Print    func(w io.Writer, result []byte) error            // Print Command Result
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"list": {
+			Help:  "List all stickers",
+			Parse: parseNone,
+			Run: func(ctx context.Context, r Request) (any, error) {
+				env.DatabaseMtx.RLock()
+				defer env.DatabaseMtx.RUnlock()
+				return slices.Clone(env.Database.Stickers), nil
+			},
+			Print: printStickers,
+		},
+		"broken": {
+			Help:  "List stickers that could not be rendered",
+			Parse: parseNone,
+			Run: func(ctx context.Context, r Request) (any, error) {
+				env.DatabaseMtx.RLock()
+				defer env.DatabaseMtx.RUnlock()
+				broken := make([]env.DatabaseSticker, 0)
+				for _, s := range env.Database.Stickers {
+					if s.Broken != "" {
+						broken = append(broken, s)
+					}
+				}
+				return broken, nil
+			},
+			Print: printBroken,
+		},
+		"flagged": {
+			Help:  "List stickers flagged for review",
+			Parse: parseNone,
+			Run: func(ctx context.Context, r Request) (any, error) {
+				env.DatabaseMtx.RLock()
+				defer env.DatabaseMtx.RUnlock()
+				flagged := make([]env.DatabaseSticker, 0)
+				for _, s := range env.Database.Stickers {
+					if s.Flagged != "" {
+						flagged = append(flagged, s)
+					}
+				}
+				return flagged, nil
+			},
+			Print: printFlagged,
+		},
+		"hide": {
+			Usage:    "<id>",
+			Help:     "Hide a sticker from the board",
+			Modifies: true,
+			Render:   true,
+			Parse:    parseID,
+			Run: func(ctx context.Context, r Request) (any, error) {
+				return nil, env.DatabaseSetVisible(r.ID, false)
+			},
+			Print: printOK,
+		},
+		"show": {
+			Usage:    "<id>",
+			Help:     "Show a previously hidden sticker, retrying it if broken and clearing any flag",
+			Modifies: true,
+			Render:   true,
+			Parse:    parseID,
+			Run: func(ctx context.Context, r Request) (any, error) {
+				return nil, env.DatabaseSetVisible(r.ID, true)
+			},
+			Print: printOK,
+		},
+		"delete": {
+			Usage:    "<id>",
+			Help:     "Delete a sticker",
+			Modifies: true,
+			Render:   true,
+			Parse:    parseID,
+			Run: func(ctx context.Context, r Request) (any, error) {
+				return nil, env.DatabaseDelete(r.ID)
+			},
+			Print: printOK,
+		},
+		"ban": {
+			Usage:    "<cidr> [reason]",
+			Help:     "Ban an address or address range from posting",
+			Modifies: true,
+			Parse: func(args []string) (Request, error) {
+				if len(args) < 1 {
+					return Request{}, errUsage
+				}
+				return Request{CIDR: args[0], Reason: strings.Join(args[1:], " ")}, nil
+			},
+			Run: func(ctx context.Context, r Request) (any, error) {
+				return env.DatabaseBanAdd(r.CIDR, r.Reason)
+			},
+			Print: printOK,
+		},
+		"unban": {
+			Usage:    "<cidr>",
+			Help:     "Lift a ban",
+			Modifies: true,
+			Parse: func(args []string) (Request, error) {
+				if len(args) != 1 {
+					return Request{}, errUsage
+				}
+				return Request{CIDR: args[0]}, nil
+			},
+			Run: func(ctx context.Context, r Request) (any, error) {
+				return nil, env.DatabaseBanRemove(r.CIDR)
+			},
+			Print: printOK,
+		},
+		"block": {
+			Usage:    "<id> [reason]",
+			Help:     "Delete an abusive sticker and refuse similar images in future",
+			Modifies: true,
+			Render:   true,
+			Parse: func(args []string) (Request, error) {
+				if len(args) < 1 {
+					return Request{}, errUsage
+				}
+				r, err := parseID(args[:1])
+				r.Reason = strings.Join(args[1:], " ")
+				return r, err
+			},
+			Run: func(ctx context.Context, r Request) (any, error) {
+				return env.BlocklistSticker(r.ID, r.Reason)
+			},
+			Print: printBlocklist,
+		},
+		"unblock": {
+			Usage:    "<hash>",
+			Help:     "Remove an image hash from the blocklist",
+			Modifies: true,
+			Parse: func(args []string) (Request, error) {
+				if len(args) != 1 {
+					return Request{}, errUsage
+				}
+				return Request{Hash: args[0]}, nil
+			},
+			Run: func(ctx context.Context, r Request) (any, error) {
+				return nil, env.BlocklistRemove(r.Hash)
+			},
+			Print: printOK,
+		},
+		"blocklist": {
+			Help:  "List all blocked image hashes",
+			Parse: parseNone,
+			Run: func(ctx context.Context, r Request) (any, error) {
+				env.DatabaseMtx.RLock()
+				defer env.DatabaseMtx.RUnlock()
+				return slices.Clone(env.Database.Blocklist), nil
+			},
+			Print: printBlocklist,
+		},
+		"bans": {
+			Help:  "List all bans",
+			Parse: parseNone,
+			Run: func(ctx context.Context, r Request) (any, error) {
+				env.DatabaseMtx.RLock()
+				defer env.DatabaseMtx.RUnlock()
+				return slices.Clone(env.Database.Bans), nil
+			},
+			Print: printBans,
+		},
+		"render": {
+			Usage:    "[--out file]",
+			Help:     "Render the stickerboard, by default replacing the one being served",
+			Modifies: true,
+			Parse: func(args []string) (Request, error) {
+				f := flag.NewFlagSet("render", flag.ContinueOnError)
+				f.SetOutput(io.Discard)
+				out := f.String("out", "", "")
+				if err := f.Parse(args); err != nil || f.NArg() > 0 {
+					return Request{}, errUsage
+				}
+				if *out == "" {
+					return Request{}, nil
+				}
+				p, err := filepath.Abs(*out)
+				return Request{Path: p}, err
+			},
+			Run: func(ctx context.Context, r Request) (any, error) {
+				if r.Path == "" {
+					return env.StickerboardRender(ctx)
+				}
+				return env.StickerboardRenderTo(ctx, r.Path)
+			},
+			Print: func(w io.Writer, result []byte) error {
+				var n int
+				if err := json.Unmarshal(result, &n); err != nil {
+					return err
+				}
+				_, err := fmt.Fprintf(w, "Rendered %d stickers\n", n)
+				return err
+			},
+		},
+		"rescan": {
+			Usage:    "[--status]",
+			Help:     "Re-moderate every sticker with the current model and policy",
+			Model:    true,
+			Modifies: true,
+			Parse: func(args []string) (Request, error) {
+				f := flag.NewFlagSet("rescan", flag.ContinueOnError)
+				f.SetOutput(io.Discard)
+				status := f.Bool("status", false, "")
+				if err := f.Parse(args); err != nil || f.NArg() > 0 {
+					return Request{}, errUsage
+				}
+				return Request{Status: *status}, nil
+			},
+			Run: func(ctx context.Context, r Request) (any, error) {
+				// A running instance scans in the background, otherwise the
+				// scan is run here and resumed by the next invocation if interrupted
+				if env.RescanServing() {
+					if !r.Status {
+						env.RescanStart()
+					}
+					return env.RescanProgress(), nil
+				}
+				if err := env.RescanLoad(); err != nil {
+					return nil, err
+				}
+				if r.Status {
+					return env.RescanProgress(), nil
+				}
+				return env.RescanRun(ctx, false)
+			},
+			Print: printRescan,
+		},
+		"classify": {
+			Usage: "<image>",
+			Help:  "Run an image through the model and print it's scores",
+			Model: true,
+			Parse: parsePath,
+			Run: func(ctx context.Context, r Request) (any, error) {
+				b, err := os.ReadFile(r.Path)
+				if err != nil {
+					return nil, err
+				}
+				frames, err := env.ImageDecodeFrames(b, env.ImageSniffType(b))
+				if err != nil {
+					return nil, err
+				}
+				scores := make([]env.ModelScores, len(frames))
+				for i := range frames {
+					if scores[i], err = env.ModelClassifyImage(frames[i]); err != nil {
+						return nil, err
+					}
+					scores[i].Text = env.ImageText(frames[i]).Score
+				}
+				return scores, nil
+			},
+			Print: printScores,
+		},
+		"caption": {
+			Usage: "<id> <file>",
+			Help:  "Save the part of a sticker most likely to be text as a PNG",
+			Parse: func(args []string) (Request, error) {
+				if len(args) != 2 {
+					return Request{}, errUsage
+				}
+				r, err := parseID(args[:1])
+				if err != nil {
+					return r, err
+				}
+				p, err := parsePath(args[1:])
+				p.ID = r.ID
+				return p, err
+			},
+			Run: func(ctx context.Context, r Request) (any, error) {
+				return env.TextCaption(r.ID, r.Path)
+			},
+			Print: func(w io.Writer, result []byte) error {
+				var est env.TextEstimate
+				if err := json.Unmarshal(result, &est); err != nil {
+					return err
+				}
+				if est.Region.Empty() {
+					_, err := fmt.Fprintf(w, "No text found, scored %.3f\n", est.Score)
+					return err
+				}
+				_, err := fmt.Fprintf(w, "Text scored %.3f across %d glyphs in %v\n", est.Score, est.Glyphs, est.Region)
+				return err
+			},
+		},
+		"export": {
+			Usage: "<file>",
+			Help:  "Export the board and it's images into a .tar.gz archive",
+			Parse: parsePath,
+			Run: func(ctx context.Context, r Request) (any, error) {
+				return env.ArchiveExport(r.Path)
+			},
+			Print: printArchive,
+		},
+		"import": {
+			Usage:    "[--replace] [--moderate] <file>",
+			Help:     "Merge an exported archive into the board, or replace it",
+			Modifies: true,
+			Render:   true,
+			Parse: func(args []string) (Request, error) {
+				f := flag.NewFlagSet("import", flag.ContinueOnError)
+				f.SetOutput(io.Discard)
+				replace := f.Bool("replace", false, "")
+				moderate := f.Bool("moderate", false, "")
+				if err := f.Parse(args); err != nil {
+					return Request{}, err
+				}
+				r, err := parsePath(f.Args())
+				r.Replace, r.Moderate = *replace, *moderate
+				return r, err
+			},
+			Run: func(ctx context.Context, r Request) (any, error) {
+				return env.ArchiveImport(ctx, r.Path, env.ArchiveOptions{
+					Replace:  r.Replace,
+					Moderate: r.Moderate,
+				})
+			},
+			Print: printArchive,
+		},
+		"verify": {
+			Usage:    "[--gc] [--quarantine]",
+			Help:     "Check every sticker has an intact image, optionally cleaning up",
+			Modifies: true,
+			Render:   true,
+			Parse: func(args []string) (Request, error) {
+				f := flag.NewFlagSet("verify", flag.ContinueOnError)
+				f.SetOutput(io.Discard)
+				gc := f.Bool("gc", false, "")
+				quarantine := f.Bool("quarantine", false, "")
+				if err := f.Parse(args); err != nil || f.NArg() > 0 {
+					return Request{}, errUsage
+				}
+				return Request{RemoveOrphans: *gc, Quarantine: *quarantine}, nil
+			},
+			Run: func(ctx context.Context, r Request) (any, error) {
+				return env.IntegrityRun(env.IntegrityOptions{
+					RemoveOrphans: r.RemoveOrphans,
+					Quarantine:    r.Quarantine,
+				})
+			},
+			Print: printIntegrity,
+		},
+	}
+}
+
+var errUsage = errors.New("invalid arguments")
+
+// Run an Admin Command against a running instance if possible, otherwise
+// directly against the data directory. Returns the process exit code.
+func Run(args []string) int {
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage(os.Stdout)
+		return 0
+	}
+	c, ok := commands[args[0]]
+	if !ok {
+		printUsage(os.Stderr)
+		return 2
+	}
+	r, err := c.Parse(args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "usage: stickerboard %s %s\n", args[0], c.Usage)
+		return 2
+	}
+
+	// Interrupting a command also cancels any render or moderation it started
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	result, err := remote(ctx, args[0], r)
+	if errors.Is(err, errOffline) {
+		result, err = local(ctx, c, r)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if err := c.Print(os.Stdout, result); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+// Run a Command directly against the Data Directory, which must not be in
+// use by a running instance
+func local(ctx context.Context, c *command, r Request) ([]byte, error) {
+	err := env.DatabaseLock()
+	if errors.Is(err, env.ErrDatabaseLocked) {
+		return nil, errors.New("an instance is running but cannot be reached through ADMIN_SOCKET")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := env.DatabaseLoad(); err != nil {
+		return nil, err
+	}
+	if c.Model || r.Moderate {
+		if err := env.ModelLoad(); err != nil {
+			return nil, err
+		}
+		if err := env.VerdictsLoad(); err != nil {
+			return nil, err
+		}
+		defer env.VerdictsSave()
+	}
+	result, err := c.Run(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	if c.Modifies {
+		if err := env.DatabaseSave(); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(result)
+}
+
+func printUsage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	fmt.Fprintln(w, "usage: stickerboard [serve | <command> [arguments]]")
+	fmt.Fprintln(w)
+	t := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(t, "  %s %s\t%s\n", name, commands[name].Usage, commands[name].Help)
+	}
+	t.Flush()
+}
+
+func parseNone(args []string) (Request, error) {
+	if len(args) != 0 {
+		return Request{}, errUsage
+	}
+	return Request{}, nil
+}
+
+func parseID(args []string) (Request, error) {
+	if len(args) != 1 {
+		return Request{}, errUsage
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return Request{}, errUsage
+	}
+	return Request{ID: id}, nil
+}
+
+// Paths are made absolute as a running instance may have a different working directory
+func parsePath(args []string) (Request, error) {
+	if len(args) != 1 {
+		return Request{}, errUsage
+	}
+	p, err := filepath.Abs(args[0])
+	return Request{Path: p}, err
+}
+
+func printOK(w io.Writer, result []byte) error {
+	_, err := fmt.Fprintln(w, "OK")
+	return err
+}
+
+func printStickers(w io.Writer, result []byte) error {
+	var stickers []env.DatabaseSticker
+	if err := json.Unmarshal(result, &stickers); err != nil {
+		return err
+	}
+	t := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(t, "ID\tCREATED\tVISIBLE\tADDRESS\tNAME\tIMAGE\tMESSAGE")
+	for _, s := range stickers {
+		fmt.Fprintf(t, "%d\t%s\t%t\t%s\t%s\t%s\t%s\n",
+			s.ID, s.Created.Format("2006-01-02 15:04"), s.Visible, s.UserAddress,
+			truncate(s.UserName, 24), truncate(s.ImageHash, 8), truncate(s.Message, 40),
+		)
+	}
+	return t.Flush()
+}
+
+func printBroken(w io.Writer, result []byte) error {
+	var stickers []env.DatabaseSticker
+	if err := json.Unmarshal(result, &stickers); err != nil {
+		return err
+	}
+	t := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(t, "ID\tVISIBLE\tIMAGE\tREASON")
+	for _, s := range stickers {
+		fmt.Fprintf(t, "%d\t%t\t%s\t%s\n", s.ID, s.Visible, truncate(s.ImageHash, 8), s.Broken)
+	}
+	return t.Flush()
+}
+
+func printFlagged(w io.Writer, result []byte) error {
+	var stickers []env.DatabaseSticker
+	if err := json.Unmarshal(result, &stickers); err != nil {
+		return err
+	}
+	t := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(t, "ID\tVISIBLE\tIMAGE\tDRAWING\tHENTAI\tNEUTRAL\tPORN\tSEXY\tTEXT\tREASON")
+	for _, s := range stickers {
+		scores := "-\t-\t-\t-\t-\t-"
+		if f := s.FlagScores; f != nil {
+			scores = fmt.Sprintf("%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f", f.Drawing, f.Hentai, f.Neutral, f.Porn, f.Sexy, f.Text)
+		}
+		fmt.Fprintf(t, "%d\t%t\t%s\t%s\t%s\n", s.ID, s.Visible, truncate(s.ImageHash, 8), scores, s.Flagged)
+	}
+	return t.Flush()
+}
+
+func printRescan(w io.Writer, result []byte) error {
+	var s env.RescanStatus
+	if err := json.Unmarshal(result, &s); err != nil {
+		return err
+	}
+	state := "incomplete"
+	switch {
+	case s.Running:
+		state = "running"
+	case s.Started.IsZero():
+		state = "never run"
+	case !s.Finished.IsZero():
+		state = "finished " + s.Finished.Format("2006-01-02 15:04")
+	}
+	fmt.Fprintf(w, "Rescan %s (model %s, policy %s)\n", state, s.Model, s.Policy)
+	fmt.Fprintf(w, "Scanned %d of %d stickers, %d failed, %d hidden, %d flagged\n",
+		s.Scanned, s.Total, len(s.Failed), len(s.Hidden), len(s.Flagged))
+	return nil
+}
+
+func printBans(w io.Writer, result []byte) error {
+	var bans []env.DatabaseBan
+	if err := json.Unmarshal(result, &bans); err != nil {
+		return err
+	}
+	t := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(t, "CIDR\tCREATED\tREASON")
+	for _, b := range bans {
+		fmt.Fprintf(t, "%s\t%s\t%s\n", b.CIDR, b.Created.Format("2006-01-02 15:04"), b.Reason)
+	}
+	return t.Flush()
+}
+
+func printBlocklist(w io.Writer, result []byte) error {
+	var blocks []env.DatabaseBlock
+	if err := json.Unmarshal(result, &blocks); err != nil {
+		return err
+	}
+	t := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(t, "HASH\tSTICKER\tCREATED\tREASON")
+	for _, b := range blocks {
+		fmt.Fprintf(t, "%s\t%d\t%s\t%s\n", b.Hash, b.StickerID, b.Created.Format("2006-01-02 15:04"), b.Reason)
+	}
+	return t.Flush()
+}
+
+func printScores(w io.Writer, result []byte) error {
+	var scores []env.ModelScores
+	if err := json.Unmarshal(result, &scores); err != nil {
+		return err
+	}
+	t := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(t, "FRAME\tDRAWING\tHENTAI\tNEUTRAL\tPORN\tSEXY\tTEXT\tSCORE\tSAFE")
+	for i, s := range scores {
+		fmt.Fprintf(t, "%d\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%t\n",
+			i, s.Drawing, s.Hentai, s.Neutral, s.Porn, s.Sexy, s.Text, s.Score(), s.Safe(),
+		)
+	}
+	return t.Flush()
+}
+
+func printArchive(w io.Writer, result []byte) error {
+	var report env.ArchiveReport
+	if err := json.Unmarshal(result, &report); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Stickers: %d\nImages: %d\n", report.Stickers, report.Images)
+	for _, s := range report.Skipped {
+		fmt.Fprintln(w, "Skipped:", s)
+	}
+	for _, id := range report.Hidden {
+		fmt.Fprintln(w, "Hidden by Moderation:", id)
+	}
+	return nil
+}
+
+func printIntegrity(w io.Writer, result []byte) error {
+	var report env.IntegrityReport
+	if err := json.Unmarshal(result, &report); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Checked %d stickers, %d problems, %d orphans (%d removed)\n",
+		report.Checked, len(report.Problems), len(report.Orphans), len(report.Removed))
+	if len(report.Problems) > 0 {
+		t := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(t, "ID\tIMAGE\tPROBLEM\tDETAIL")
+		for _, p := range report.Problems {
+			fmt.Fprintf(t, "%d\t%s\t%s\t%s\n", p.ID, p.Hash, p.Problem, p.Detail)
+		}
+		t.Flush()
+	}
+	for _, name := range report.Orphans {
+		fmt.Fprintln(w, "Orphan:", name)
+	}
+	for _, id := range report.Quarantined {
+		fmt.Fprintln(w, "Quarantined:", id)
+	}
+	return nil
+}
+
+func truncate(s string, n int) string {
+	s = strings.ReplaceAll(s, "\n", " ")
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
@@ -0,0 +1,166 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"bakonpancakz/stickerboard/env"
+)
+
+const SOCKET_MODE = os.FileMode(0660)
+
+var errOffline = errors.New("no running instance")
+
+type response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Listen for Admin Commands on a Unix Socket, allowing a running instance to be
+// moderated without restarting it
+func SetupSocket(stop context.Context, await *sync.WaitGroup) {
+	if env.ADMIN_SOCKET == "" {
+		return
+	}
+
+	listener, err := env.ListenUnix(env.ADMIN_SOCKET, SOCKET_MODE)
+	if err != nil {
+		env.LogFatal("[admin] Listen Error", "error", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /{command}", func(w http.ResponseWriter, r *http.Request) {
+		handleCommand(stop, w, r)
+	})
+	svr := http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	// Shutdown Logic
+	await.Add(1)
+	go func() {
+		defer await.Done()
+		<-stop.Done()
+		svr.Shutdown(context.Background())
+		slog.Info("[admin] Cleaned up Socket")
+	}()
+
+	go func() {
+		if err := svr.Serve(listener); err != http.ErrServerClosed {
+			env.LogFatal("[admin] Serve Error", "error", err)
+		}
+	}()
+	slog.Info("[admin] Bound Socket", "path", env.ADMIN_SOCKET)
+}
+
+// Commands are cancelled if the client disconnects or the server is shutting down
+func handleCommand(stop context.Context, w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("command")
+	c, ok := commands[name]
+	if !ok {
+		writeResponse(w, http.StatusNotFound, nil, fmt.Errorf("unknown command: %s", name))
+		return
+	}
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeResponse(w, http.StatusBadRequest, nil, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	defer context.AfterFunc(stop, cancel)()
+
+	version := env.DatabaseVersion.Load()
+	result, err := c.Run(ctx, req)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, nil, err)
+		return
+	}
+	slog.Info("[admin] Ran Command", "command", name, "request", req)
+	if c.Render && env.DatabaseVersion.Load() != version {
+		if _, err := env.StickerboardRender(ctx); err != nil {
+			slog.Error("[admin] Render Error", "error", err)
+		}
+	}
+	writeResponse(w, http.StatusOK, result, nil)
+}
+
+func writeResponse(w http.ResponseWriter, status int, result any, err error) {
+	var resp response
+	if err != nil {
+		resp.Error = err.Error()
+	} else if b, err := json.Marshal(result); err != nil {
+		status = http.StatusInternalServerError
+		resp.Error = err.Error()
+	} else {
+		resp.Result = b
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Send a Command to a running instance, returning errOffline if none is
+// listening. Any other failure, such as lacking permission to use the socket,
+// is returned as is since an instance may well be running.
+func remote(ctx context.Context, name string, r Request) ([]byte, error) {
+	if env.ADMIN_SOCKET == "" {
+		return nil, errOffline
+	}
+	conn, err := net.Dial("unix", env.ADMIN_SOCKET)
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+		return nil, errOffline
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach running instance: %w", err)
+	}
+	conn.Close()
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", env.ADMIN_SOCKET)
+			},
+		},
+	}
+
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://admin/"+name, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var decoded response
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return nil, err
+	}
+	if decoded.Error != "" {
+		return nil, errors.New(decoded.Error)
+	}
+	return decoded.Result, nil
+}
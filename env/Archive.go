@@ -0,0 +1,461 @@
+package env
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// Boards are archived as a gzipped tarball containing the following files,
+// the manifest is always written first so it can be checked while streaming
+const (
+	ARCHIVE_VERSION  = 1
+	ARCHIVE_MANIFEST = "manifest.json"
+	ARCHIVE_DATABASE = "database.json"
+	ARCHIVE_IMAGES   = "images/"
+)
+
+var (
+	archiveImageName = regexp.MustCompile(`^images/[0-9A-F]{40}$`)
+	archiveImageHash = regexp.MustCompile(`^[0-9A-F]{40}$`)
+)
+
+type ArchiveManifest struct {
+	Version int            `json:"version"` // Archive Format Version
+	Created time.Time      `json:"created"` // Archive Created
+	Files   []ArchiveEntry `json:"files"`   // Files following the Manifest
+}
+
+type ArchiveEntry struct {
+	Name   string `json:"name"`   // Path within Archive
+	Size   int64  `json:"size"`   // Size in Bytes
+	SHA256 string `json:"sha256"` // Checksum of Contents
+}
+
+type ArchiveOptions struct {
+	Replace  bool // Replace the existing board instead of merging into it?
+	Moderate bool // Run imported stickers through the model?
+}
+
+type ArchiveReport struct {
+	Stickers int      `json:"stickers"` // Stickers Exported or Imported
+	Images   int      `json:"images"`   // Image Files Exported or Imported
+	Skipped  []string `json:"skipped"`  // Stickers or Files that were left out
+	Hidden   []int    `json:"hidden"`   // Imported Stickers hidden by moderation
+}
+
+// Write the Database, every referenced Image and the Background into an Archive
+func ArchiveExport(outputPath string) (ArchiveReport, error) {
+	report := ArchiveReport{Skipped: []string{}, Hidden: []int{}}
+
+	// Snapshot Database
+	DatabaseMtx.RLock()
+	databaseBytes, err := json.MarshalIndent(&Database, "", "    ")
+	hashes := make([]string, 0, len(Database.Stickers))
+	for _, s := range Database.Stickers {
+		if !slices.Contains(hashes, s.ImageHash) {
+			hashes = append(hashes, s.ImageHash)
+		}
+	}
+	report.Stickers = len(Database.Stickers)
+	DatabaseMtx.RUnlock()
+	if err != nil {
+		return report, err
+	}
+
+	// Collect Files and Checksums
+	type source struct {
+		Name string
+		Path string
+		Data []byte
+	}
+	sources := []source{{Name: ARCHIVE_DATABASE, Data: databaseBytes}}
+	for _, h := range hashes {
+		sources = append(sources, source{Name: ARCHIVE_IMAGES + h, Path: path.Join(DATA_DIRECTORY, h)})
+	}
+	if _, err := os.Stat(StickerboardBackgroundPath); err == nil {
+		sources = append(sources, source{Name: BACKGROUND_FILENAME, Path: StickerboardBackgroundPath})
+	}
+	manifest := ArchiveManifest{
+		Version: ARCHIVE_VERSION,
+		Created: time.Now(),
+		Files:   make([]ArchiveEntry, 0, len(sources)),
+	}
+	included := make([]source, 0, len(sources))
+	for _, s := range sources {
+		var entry ArchiveEntry
+		if s.Data == nil {
+			size, sum, err := archiveChecksumFile(s.Path)
+			if err != nil {
+				slog.Warn("[archive] Skipping Unreadable File", "path", s.Path, "error", err)
+				report.Skipped = append(report.Skipped, s.Name)
+				continue
+			}
+			entry = ArchiveEntry{Name: s.Name, Size: size, SHA256: sum}
+		} else {
+			sum := sha256.Sum256(s.Data)
+			entry = ArchiveEntry{Name: s.Name, Size: int64(len(s.Data)), SHA256: hex.EncodeToString(sum[:])}
+		}
+		manifest.Files = append(manifest.Files, entry)
+		included = append(included, s)
+		if s.Name != ARCHIVE_DATABASE && s.Name != BACKGROUND_FILENAME {
+			report.Images++
+		}
+	}
+	manifestBytes, err := json.MarshalIndent(&manifest, "", "    ")
+	if err != nil {
+		return report, err
+	}
+
+	// Write Archive to a Temporary File then move it into place
+	f, err := os.CreateTemp(path.Dir(outputPath), TEMP_PREFIX+"export-*")
+	if err != nil {
+		return report, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	header := func(name string, size int64) error {
+		return tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0640,
+			Size:    size,
+			ModTime: manifest.Created,
+		})
+	}
+	if err := header(ARCHIVE_MANIFEST, int64(len(manifestBytes))); err != nil {
+		return report, err
+	}
+	if _, err := tw.Write(manifestBytes); err != nil {
+		return report, err
+	}
+
+	// Images are streamed from disk rather than held in memory, they are named
+	// by their contents so cannot change size after being checksummed
+	for i, s := range included {
+		if err := header(s.Name, manifest.Files[i].Size); err != nil {
+			return report, err
+		}
+		if s.Data != nil {
+			if _, err := tw.Write(s.Data); err != nil {
+				return report, err
+			}
+			continue
+		}
+		if err := archiveCopyFile(tw, s.Path, manifest.Files[i].Size); err != nil {
+			return report, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return report, err
+	}
+	if err := gz.Close(); err != nil {
+		return report, err
+	}
+	if err := f.Close(); err != nil {
+		return report, err
+	}
+	return report, os.Rename(f.Name(), outputPath)
+}
+
+// Read an Archive created by ArchiveExport, validating every file against the
+// manifest before merging it into (or replacing) the current board
+func ArchiveImport(ctx context.Context, inputPath string, options ArchiveOptions) (ArchiveReport, error) {
+	report := ArchiveReport{Skipped: []string{}, Hidden: []int{}}
+
+	f, err := os.Open(inputPath)
+	if err != nil {
+		return report, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return report, err
+	}
+	tr := tar.NewReader(gz)
+
+	// Read Manifest
+	h, err := tr.Next()
+	if err != nil {
+		return report, err
+	}
+	if h.Name != ARCHIVE_MANIFEST {
+		return report, errors.New("archive does not begin with a manifest")
+	}
+	var manifest ArchiveManifest
+	maxBytes := Config().Limits.MaxUploadBytes
+	if err := json.NewDecoder(io.LimitReader(tr, maxBytes)).Decode(&manifest); err != nil {
+		return report, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if manifest.Version != ARCHIVE_VERSION {
+		return report, fmt.Errorf("unsupported archive version: %d", manifest.Version)
+	}
+	expected := make(map[string]ArchiveEntry, len(manifest.Files))
+	for _, e := range manifest.Files {
+		expected[e.Name] = e
+	}
+
+	// Extract Files into the Data Directory under Temporary Names, they are only
+	// moved into place once the entire archive has been validated
+	staged := make(map[string]string)
+	defer func() {
+		for _, p := range staged {
+			os.Remove(p)
+		}
+	}()
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+		entry, ok := expected[h.Name]
+		if !ok || h.Typeflag != tar.TypeReg ||
+			!(h.Name == ARCHIVE_DATABASE || h.Name == BACKGROUND_FILENAME || archiveImageName.MatchString(h.Name)) {
+			return report, fmt.Errorf("unexpected file in archive: %s", h.Name)
+		}
+		if h.Size != entry.Size || h.Size > maxBytes*4 {
+			return report, fmt.Errorf("size mismatch: %s", h.Name)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return report, err
+		}
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != entry.SHA256 {
+			return report, fmt.Errorf("checksum mismatch: %s", h.Name)
+		}
+		if name := path.Base(h.Name); archiveImageName.MatchString(h.Name) &&
+			fmt.Sprintf("%X", sha1.Sum(data)) != name {
+			return report, fmt.Errorf("image does not match it's name: %s", h.Name)
+		}
+		p, err := archiveStage(data)
+		if err != nil {
+			return report, err
+		}
+		staged[h.Name] = p
+		delete(expected, h.Name)
+	}
+	for name := range expected {
+		return report, fmt.Errorf("archive is missing file: %s", name)
+	}
+
+	// Decode Database
+	databasePath, ok := staged[ARCHIVE_DATABASE]
+	if !ok {
+		return report, errors.New("archive is missing a database")
+	}
+	databaseBytes, err := os.ReadFile(databasePath)
+	if err != nil {
+		return report, err
+	}
+	var imported DatabaseRoot
+	if err := json.Unmarshal(databaseBytes, &imported); err != nil {
+		return report, fmt.Errorf("invalid database: %w", err)
+	}
+
+	// Validate Stickers against their Images
+	maxDimension := Config().Limits.MaxDimension
+	accepted := make([]DatabaseSticker, 0, len(imported.Stickers))
+	acceptedPaths := make([]string, 0, len(imported.Stickers))
+	for _, s := range imported.Stickers {
+		// Hashes come from the archive so must not be trusted as a path
+		if !archiveImageHash.MatchString(s.ImageHash) {
+			report.Skipped = append(report.Skipped, fmt.Sprintf("sticker %d: invalid image hash", s.ID))
+			continue
+		}
+		imagePath, ok := staged[ARCHIVE_IMAGES+s.ImageHash]
+		if !ok {
+			imagePath = path.Join(DATA_DIRECTORY, s.ImageHash)
+		}
+		data, err := os.ReadFile(imagePath)
+		if err != nil {
+			report.Skipped = append(report.Skipped, fmt.Sprintf("sticker %d: missing image", s.ID))
+			continue
+		}
+		if !ok && fmt.Sprintf("%X", sha1.Sum(data)) != s.ImageHash {
+			report.Skipped = append(report.Skipped, fmt.Sprintf("sticker %d: image does not match it's hash", s.ID))
+			continue
+		}
+		if t := ImageSniffType(data); t == IMAGE_OTHER || t != s.ImageType {
+			report.Skipped = append(report.Skipped, fmt.Sprintf("sticker %d: image type %s", s.ID, t))
+			continue
+		}
+		// Placement is checked against the image itself as uploads are, so a
+		// sticker cannot be placed off the board or rendered at any size
+		imageInfo, err := ImageDecodeConfig(data, s.ImageType)
+		if err != nil {
+			report.Skipped = append(report.Skipped, fmt.Sprintf("sticker %d: invalid image: %v", s.ID, err))
+			continue
+		}
+		if imageInfo.Width != s.ImageWidth || imageInfo.Height != s.ImageHeight {
+			report.Skipped = append(report.Skipped, fmt.Sprintf("sticker %d: image is %dx%d, not %dx%d",
+				s.ID, imageInfo.Width, imageInfo.Height, s.ImageWidth, s.ImageHeight))
+			continue
+		}
+		if max(imageInfo.Width, imageInfo.Height) > maxDimension {
+			report.Skipped = append(report.Skipped, fmt.Sprintf("sticker %d: image larger than %d pixels", s.ID, maxDimension))
+			continue
+		}
+		if err := StickerboardValidateSticker(s); err != nil {
+			report.Skipped = append(report.Skipped, fmt.Sprintf("sticker %d: invalid placement: %v", s.ID, err))
+			continue
+		}
+		accepted = append(accepted, s)
+		acceptedPaths = append(acceptedPaths, imagePath)
+	}
+
+	// Moderate Visible Stickers
+	if options.Moderate {
+		unsafe := make([]bool, len(accepted))
+		if err := Multithread(ctx, WORKER_LIMIT, len(accepted), func(ctx context.Context, i int) error {
+			if !accepted[i].Visible {
+				return nil
+			}
+			data, err := os.ReadFile(acceptedPaths[i])
+			if err != nil {
+				return err
+			}
+			safe, err := archiveModerate(accepted[i].ImageHash, data, accepted[i].ImageType)
+			unsafe[i] = !safe
+			return err
+		}); err != nil {
+			return report, err
+		}
+		for i := range accepted {
+			if unsafe[i] {
+				accepted[i].Visible = false
+				report.Hidden = append(report.Hidden, accepted[i].ID)
+			}
+		}
+	}
+
+	// Move Images into Place
+	for name, p := range staged {
+		if !archiveImageName.MatchString(name) {
+			continue
+		}
+		if err := os.Rename(p, path.Join(DATA_DIRECTORY, path.Base(name))); err != nil {
+			return report, err
+		}
+		delete(staged, name)
+		report.Images++
+	}
+	if p, ok := staged[BACKGROUND_FILENAME]; ok {
+		if _, err := os.Stat(StickerboardBackgroundPath); options.Replace || err != nil {
+			if err := os.Rename(p, StickerboardBackgroundPath); err != nil {
+				return report, err
+			}
+			delete(staged, BACKGROUND_FILENAME)
+			StickerboardLoadBackground()
+		}
+	}
+
+	// Update Database
+	DatabaseMtx.Lock()
+	if options.Replace {
+		Database.Sequence = imported.Sequence
+		Database.Stickers = make([]DatabaseSticker, 0, len(accepted))
+		Database.Bans = make([]DatabaseBan, 0, len(imported.Bans))
+		Database.Blocklist = make([]DatabaseBlock, 0, len(imported.Blocklist))
+	}
+	for _, s := range accepted {
+		// Skip Stickers already on the Board
+		if slices.ContainsFunc(Database.Stickers, func(e DatabaseSticker) bool {
+			return e.Created.Equal(s.Created) && e.ImageHash == s.ImageHash
+		}) {
+			report.Skipped = append(report.Skipped, fmt.Sprintf("sticker %d: already exists", s.ID))
+			continue
+		}
+		// IDs are kept when replacing, otherwise new ones are assigned to prevent collisions
+		if _, err := DatabaseFind(s.ID); !options.Replace || s.ID == 0 || err == nil {
+			s.ID = DatabaseNextID()
+		}
+		Database.Sequence = max(Database.Sequence, s.ID)
+		Database.Stickers = append(Database.Stickers, s)
+		report.Stickers++
+	}
+	for _, b := range imported.Bans {
+		if !slices.ContainsFunc(Database.Bans, func(e DatabaseBan) bool { return e.CIDR == b.CIDR }) {
+			Database.Bans = append(Database.Bans, b)
+		}
+	}
+	for _, b := range imported.Blocklist {
+		if !slices.ContainsFunc(Database.Blocklist, func(e DatabaseBlock) bool { return e.Hash == b.Hash }) {
+			Database.Blocklist = append(Database.Blocklist, b)
+		}
+	}
+	DatabaseVersion.Add(1)
+	DatabaseMtx.Unlock()
+
+	return report, nil
+}
+
+// Returns the Size and SHA256 Checksum of a File, reading it in pieces
+func archiveChecksumFile(filePath string) (int64, string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Copy exactly size Bytes of a File into the Archive
+func archiveCopyFile(w io.Writer, filePath string, size int64) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(w, f, size); err != nil {
+		return fmt.Errorf("%s changed while exporting: %w", filePath, err)
+	}
+	return nil
+}
+
+// Write Data to a uniquely named Temporary File in the Data Directory
+func archiveStage(data []byte) (string, error) {
+	var b [8]byte
+	rand.Read(b[:])
+	p := path.Join(DATA_DIRECTORY, TEMP_PREFIX+"import-"+hex.EncodeToString(b[:]))
+	return p, WriteFileAtomic(p, data)
+}
+
+// Returns true if every Frame of the Image is considered safe and it does
+// not resemble a blocked image
+func archiveModerate(hash string, data []byte, t ImageType) (bool, error) {
+	if v, ok := VerdictLookup(hash); ok && !v.Safe {
+		return false, nil
+	}
+	frames, err := ImageDecodeFrames(data, t)
+	if err != nil {
+		return false, nil
+	}
+	if _, blocked := BlocklistMatch(ImagePerceptualHashes(frames)); blocked {
+		return false, nil
+	}
+	v, err := VerdictClassify(hash, frames)
+	return v.Safe, err
+}
@@ -0,0 +1,185 @@
+package env
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math/bits"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// Difference Hash of an Image, similar images have hashes which differ by only
+// a few bits even after being resized, recompressed or slightly edited
+type PerceptualHash uint64
+
+const (
+	PERCEPTUAL_WIDTH      = 9  // Hashed Image Width, one more than bits per row
+	PERCEPTUAL_HEIGHT     = 8  // Hashed Image Height
+	PERCEPTUAL_MIN_DETAIL = 12 // Bits which must be set (or unset) for a Hash to be compared
+)
+
+func (h PerceptualHash) String() string {
+	return fmt.Sprintf("%016x", uint64(h))
+}
+
+func (h PerceptualHash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+func (h *PerceptualHash) UnmarshalText(b []byte) error {
+	v, err := strconv.ParseUint(string(b), 16, 64)
+	if err != nil || len(b) != 16 {
+		return fmt.Errorf("invalid perceptual hash: %q", b)
+	}
+	*h = PerceptualHash(v)
+	return nil
+}
+
+// Number of Bits which differ between two Hashes
+func (h PerceptualHash) Distance(o PerceptualHash) int {
+	return bits.OnesCount64(uint64(h ^ o))
+}
+
+// Returns true if the Hash has too little detail to tell Images apart, flat
+// or mostly empty frames all hash to nearly zero
+func (h PerceptualHash) Flat() bool {
+	n := bits.OnesCount64(uint64(h))
+	return n < PERCEPTUAL_MIN_DETAIL || n > 64-PERCEPTUAL_MIN_DETAIL
+}
+
+// Calculate the Difference Hash of an Image, transparent areas are treated as
+// white so the hash reflects what is drawn rather than hidden colour data
+func ImagePerceptualHash(img image.Image) PerceptualHash {
+	small := image.NewRGBA(image.Rect(0, 0, PERCEPTUAL_WIDTH, PERCEPTUAL_HEIGHT))
+	draw.Draw(small, small.Rect, image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.BiLinear.Scale(small, small.Rect, img, img.Bounds(), draw.Over, nil)
+
+	var hash PerceptualHash
+	for y := 0; y < PERCEPTUAL_HEIGHT; y++ {
+		for x := 0; x < PERCEPTUAL_WIDTH-1; x++ {
+			hash <<= 1
+			if perceptualLuma(small, x, y) < perceptualLuma(small, x+1, y) {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+func perceptualLuma(img *image.RGBA, x, y int) int {
+	p := img.Pix[img.PixOffset(x, y):]
+	return 299*int(p[0]) + 587*int(p[1]) + 114*int(p[2])
+}
+
+// Hash every Frame of an Image, identical hashes are only returned once and
+// flat ones not at all as they would match every other plain image
+func ImagePerceptualHashes(frames []image.Image) []PerceptualHash {
+	hashes := make([]PerceptualHash, 0, len(frames))
+	for _, frame := range frames {
+		if h := ImagePerceptualHash(frame); !h.Flat() && !slices.Contains(hashes, h) {
+			hashes = append(hashes, h)
+		}
+	}
+	return hashes
+}
+
+// Returns the Blocklist Entry closest to any of the given hashes if it is
+// within the configured distance
+func BlocklistMatch(hashes []PerceptualHash) (DatabaseBlock, bool) {
+	limit := Config().Moderation.BlockDistance
+	if limit < 0 {
+		return DatabaseBlock{}, false
+	}
+	DatabaseMtx.RLock()
+	defer DatabaseMtx.RUnlock()
+
+	var best DatabaseBlock
+	bestDistance := limit + 1
+	for _, block := range Database.Blocklist {
+		if block.Hash.Flat() {
+			continue
+		}
+		for _, h := range hashes {
+			if d := block.Hash.Distance(h); d < bestDistance && !h.Flat() {
+				best, bestDistance = block, d
+			}
+		}
+	}
+	return best, bestDistance <= limit
+}
+
+// Remove a Sticker as abusive, adding the hashes of it's frames to the
+// blocklist so it cannot be uploaded again
+func BlocklistSticker(id int, reason string) ([]DatabaseBlock, error) {
+	DatabaseMtx.RLock()
+	i, err := DatabaseFind(id)
+	var sticker DatabaseSticker
+	if err == nil {
+		sticker = Database.Stickers[i]
+	}
+	DatabaseMtx.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Frames are hashed again as stickers may predate hashing or have been
+	// hashed before animated frames were composited, stored hashes are only
+	// used if the image can no longer be read
+	hashes := sticker.ImageHashes
+	var frames []image.Image
+	data, err := os.ReadFile(path.Join(DATA_DIRECTORY, sticker.ImageHash))
+	if err == nil {
+		frames, err = ImageDecodeFrames(data, sticker.ImageType)
+	}
+	switch {
+	case err == nil:
+		hashes = ImagePerceptualHashes(frames)
+	case len(hashes) == 0:
+		return nil, err
+	}
+
+	DatabaseMtx.Lock()
+	defer DatabaseMtx.Unlock()
+	added := make([]DatabaseBlock, 0, len(hashes))
+	for _, h := range hashes {
+		if h.Flat() || slices.ContainsFunc(Database.Blocklist, func(e DatabaseBlock) bool { return e.Hash == h }) {
+			continue
+		}
+		block := DatabaseBlock{
+			Created:   time.Now(),
+			Hash:      h,
+			StickerID: id,
+			Reason:    reason,
+		}
+		Database.Blocklist = append(Database.Blocklist, block)
+		added = append(added, block)
+	}
+	if i, err := DatabaseFind(id); err == nil {
+		Database.Stickers = slices.Delete(Database.Stickers, i, i+1)
+		DatabaseVersion.Add(1)
+	}
+	return added, nil
+}
+
+// Lift a Blocklist Entry previously created with BlocklistSticker
+func BlocklistRemove(hash string) error {
+	var h PerceptualHash
+	if err := h.UnmarshalText([]byte(hash)); err != nil {
+		return err
+	}
+	DatabaseMtx.Lock()
+	defer DatabaseMtx.Unlock()
+	for i, block := range Database.Blocklist {
+		if block.Hash == h {
+			Database.Blocklist = slices.Delete(Database.Blocklist, i, i+1)
+			return nil
+		}
+	}
+	return ErrBlockNotFound
+}
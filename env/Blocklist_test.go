@@ -0,0 +1,122 @@
+package env
+
+import (
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+func testUniform(w, h int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// Detailed Image with a hash well away from flat
+func testDetailed(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x*x + y*37) % 256)
+			img.Set(x, y, color.RGBA{v, 255 - v, v / 2, 255})
+		}
+	}
+	return img
+}
+
+func TestPerceptualHashFlat(t *testing.T) {
+	mark := testUniform(64, 64, color.White)
+	for y := 28; y < 36; y++ {
+		for x := 28; x < 36; x++ {
+			mark.Set(x, y, color.Black)
+		}
+	}
+	for name, img := range map[string]image.Image{
+		"white":       testUniform(64, 64, color.White),
+		"black":       testUniform(64, 64, color.Black),
+		"transparent": testUniform(64, 64, color.Transparent),
+		"mark":        mark,
+	} {
+		if h := ImagePerceptualHash(img); !h.Flat() {
+			t.Errorf("%s: hash %s should be flat", name, h)
+		}
+		if hashes := ImagePerceptualHashes([]image.Image{img}); len(hashes) != 0 {
+			t.Errorf("%s: flat hashes returned: %v", name, hashes)
+		}
+	}
+	if h := ImagePerceptualHash(testDetailed(64, 64)); h.Flat() {
+		t.Errorf("detailed: hash %s should not be flat", h)
+	}
+}
+
+func TestBlocklistMatchFlat(t *testing.T) {
+	DatabaseMtx.Lock()
+	previous := Database.Blocklist
+	detailed := ImagePerceptualHash(testDetailed(64, 64))
+	Database.Blocklist = []DatabaseBlock{{Hash: 0}, {Hash: detailed}}
+	DatabaseMtx.Unlock()
+	defer func() {
+		DatabaseMtx.Lock()
+		Database.Blocklist = previous
+		DatabaseMtx.Unlock()
+	}()
+
+	// A blocked flat hash (from before they were skipped) must not match plain uploads
+	plain := ImagePerceptualHashes([]image.Image{testUniform(64, 64, color.White)})
+	if block, blocked := BlocklistMatch(plain); blocked {
+		t.Errorf("plain image matched blocked hash %s", block.Hash)
+	}
+	raw := []PerceptualHash{ImagePerceptualHash(testUniform(64, 64, color.White))}
+	if block, blocked := BlocklistMatch(raw); blocked {
+		t.Errorf("flat hash matched blocked hash %s", block.Hash)
+	}
+	resized := image.NewRGBA(image.Rect(0, 0, 128, 128))
+	draw.BiLinear.Scale(resized, resized.Rect, testDetailed(64, 64), image.Rect(0, 0, 64, 64), draw.Src, nil)
+	if _, blocked := BlocklistMatch(ImagePerceptualHashes([]image.Image{resized})); !blocked {
+		t.Errorf("resized detailed image was not blocked")
+	}
+}
+
+func TestImageCompositeGIF(t *testing.T) {
+	// First frame covers the canvas, the second only changes a corner
+	full := image.NewPaletted(image.Rect(0, 0, 64, 64), palette.Plan9)
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			v := uint8((x*x + y*37) % 256)
+			full.Set(x, y, color.RGBA{v, 255 - v, v / 2, 255})
+		}
+	}
+	delta := image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9)
+	for i := range delta.Pix {
+		delta.Pix[i] = 0
+	}
+	g := &gif.GIF{
+		Image:    []*image.Paletted{full, delta},
+		Delay:    []int{10, 10},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalNone},
+		Config:   image.Config{Width: 64, Height: 64},
+	}
+
+	frames := ImageCompositeGIF(g)
+	if len(frames) != 2 {
+		t.Fatalf("expected 2 frames, got %d", len(frames))
+	}
+	if got, want := frames[1].At(40, 40), frames[0].At(40, 40); got != want {
+		t.Errorf("composited frame lost earlier pixels: got %v, want %v", got, want)
+	}
+	a, b := ImagePerceptualHash(frames[0]), ImagePerceptualHash(frames[1])
+	if d := a.Distance(b); d > 2 {
+		t.Errorf("composited frames differ by %d bits", d)
+	}
+	if hashes := ImagePerceptualHashes([]image.Image{delta}); len(hashes) != 0 {
+		t.Errorf("raw delta frame should hash as flat, got %v", hashes)
+	}
+}
@@ -0,0 +1,58 @@
+package env
+
+import (
+	"image"
+	"os"
+	"path"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	COMPOSITE_MARGIN = 64       // Pixels of the Board around a new Sticker included when classifying it in context
+	COMPOSITE_OFF    = "off"    // Stickers are only classified on their own
+	COMPOSITE_REJECT = "reject" // Stickers which are inappropriate in context are refused
+	COMPOSITE_REVIEW = "review" // Stickers which are inappropriate in context are hidden until reviewed
+)
+
+// Classify the region of the Board surrounding a new Sticker as it would appear
+// once placed, catching stickers which are only inappropriate alongside others.
+// The first frame of the sticker is drawn over the last rendered board.
+func CompositeClassify(candidate DatabaseSticker, frame image.Image) (ModelScores, image.Rectangle, error) {
+	placed := stickerboardPlace(&candidate, []image.Image{frame})
+	canvas := image.Rect(0, 0, CANVAS_WIDTH, CANVAS_HEIGHT)
+	region := placed.Position.Inset(-COMPOSITE_MARGIN).Intersect(canvas)
+	if region.Empty() {
+		return ModelScores{}, region, nil
+	}
+
+	// Start from the served board, or it's background if it has not rendered yet
+	composite := image.NewRGBA(region)
+	StickerboardMtx.RLock()
+	board := StickerboardStill
+	if board == nil {
+		board = StickerboardBack
+	}
+	draw.Draw(composite, region, board, region.Min, draw.Src)
+	StickerboardMtx.RUnlock()
+	draw.Draw(composite, placed.Position, placed.Frames[0], image.Point{}, draw.Over)
+
+	scores, err := ModelClassifyImage(composite)
+	return scores, region, err
+}
+
+// Classify a Sticker already stored on disk in context, see CompositeClassify
+func CompositeClassifyStored(s DatabaseSticker) (ModelScores, image.Rectangle, error) {
+	if cached, ok := ImageCacheGet(s.ImageHash); ok {
+		return CompositeClassify(s, cached.Frames[0])
+	}
+	data, err := os.ReadFile(path.Join(DATA_DIRECTORY, s.ImageHash))
+	if err != nil {
+		return ModelScores{}, image.Rectangle{}, err
+	}
+	frames, err := ImageDecodeFrames(data, s.ImageType)
+	if err != nil {
+		return ModelScores{}, image.Rectangle{}, err
+	}
+	return CompositeClassify(s, frames[0])
+}
@@ -0,0 +1,243 @@
+package env
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Settings which can be changed without restarting, read from CONFIG_FILE on
+// startup and again whenever the process receives SIGHUP
+type ConfigRoot struct {
+	Limits     ConfigLimits     `toml:"limits"`
+	Moderation ConfigModeration `toml:"moderation"`
+	Links      ConfigLinks      `toml:"links"`
+	Theme      ConfigTheme      `toml:"theme"`
+	Bans       []ConfigBan      `toml:"bans"`
+}
+
+type ConfigLimits struct {
+	MaxUploadBytes  int64         `toml:"max_upload_bytes"`  // Maximum Size of an Upload Form
+	MaxDimension    int           `toml:"max_dimension"`     // Maximum Image Width or Height
+	MinDimension    int           `toml:"min_dimension"`     // Minimum Image Width or Height
+	MaxMessageBytes int           `toml:"max_message_bytes"` // Maximum Sticker Message Length
+	MaxNameBytes    int           `toml:"max_name_bytes"`    // Maximum User Name Length
+	MaxURLBytes     int           `toml:"max_url_bytes"`     // Maximum User URL Length
+	EditWindow      time.Duration `toml:"edit_window"`       // Time an Author may change their Sticker for
+	MaxDuplicates   int           `toml:"max_duplicates"`    // Times the same Image may appear on the Board, 0 for unlimited
+}
+
+type ConfigModeration struct {
+	Threshold     float64  `toml:"threshold"`      // Score before an Image is considered inappropriate
+	DenyWords     []string `toml:"deny_words"`     // Words refused in User Names, URLs and Messages
+	DenyPatterns  []string `toml:"deny_patterns"`  // Regular Expressions refused in the same
+	BlockDistance int      `toml:"block_distance"` // Bits an Image may differ from a Blocked one and still be refused
+	RescanAction  string   `toml:"rescan_action"`  // What to do with Stickers failing a Rescan (flag, hide)
+	Backgrounds   []string `toml:"backgrounds"`    // Backgrounds Transparent Images are Classified on
+	Composite     string   `toml:"composite"`      // Also Classify Stickers in place on the Board (off, reject, review)
+	TextThreshold float64  `toml:"text_threshold"` // Text Estimate before a Sticker is held for review, 0 to disable
+
+	denyWords    []string         // Folded Deny Words
+	denyPatterns []*regexp.Regexp // Compiled Deny Patterns
+}
+
+type ConfigLinks struct {
+	Interstitial bool     `toml:"interstitial"`  // Send Visitors through a Warning Page before leaving?
+	AllowDomains []string `toml:"allow_domains"` // Only permit Links to these Domains (if any)
+	DenyDomains  []string `toml:"deny_domains"`  // Never permit Links to these Domains
+}
+
+type ConfigTheme struct {
+	Directory string `toml:"directory"` // Overrides THEME_DIRECTORY (if set)
+}
+
+// Bans from the Config File apply alongside those in the Database, but can
+// only be lifted by editing the file
+type ConfigBan struct {
+	CIDR   string `toml:"cidr"`
+	Reason string `toml:"reason"`
+}
+
+var (
+	config        atomic.Pointer[ConfigRoot]
+	ConfigVersion atomic.Uint64 // Incremented whenever the Configuration is Applied
+)
+
+// Returns the Current Configuration, do not modify it
+func Config() *ConfigRoot {
+	if c := config.Load(); c != nil {
+		return c
+	}
+	c := configDefaults()
+	return &c
+}
+
+func configDefaults() ConfigRoot {
+	return ConfigRoot{
+		Limits: ConfigLimits{
+			MaxUploadBytes:  1 << 24,
+			MaxDimension:    2048,
+			MinDimension:    32,
+			MaxMessageBytes: 1024,
+			MaxNameBytes:    64,
+			MaxURLBytes:     512,
+			EditWindow:      15 * time.Minute,
+		},
+		Moderation: ConfigModeration{
+			Threshold:     0.7,
+			BlockDistance: 10,
+			RescanAction:  RESCAN_FLAG,
+			Backgrounds:   []string{BACKGROUND_BLACK, BACKGROUND_WHITE, BACKGROUND_CHECKER},
+			Composite:     COMPOSITE_OFF,
+		},
+		Bans: []ConfigBan{},
+	}
+}
+
+// Reload the Config File whenever SIGHUP is received, an invalid file is
+// logged and ignored so the previous configuration stays in effect
+func SetupConfig(stop context.Context, await *sync.WaitGroup) {
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	await.Add(1)
+	go func() {
+		defer await.Done()
+		defer signal.Stop(reload)
+		for {
+			select {
+			case <-stop.Done():
+				return
+			case <-reload:
+				if err := ConfigLoad(); err != nil {
+					slog.Error("[config] Reload Failed, Keeping Previous Configuration", "path", CONFIG_FILE, "error", err)
+					continue
+				}
+				slog.Info("[config] Configuration Reloaded", "path", CONFIG_FILE)
+			}
+		}
+	}()
+}
+
+// Read, Validate and Apply the Config File, defaults are used if none is set
+func ConfigLoad() error {
+	c := configDefaults()
+	if CONFIG_FILE != "" {
+		meta, err := toml.DecodeFile(CONFIG_FILE, &c)
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return errors.New(parseErr.ErrorWithPosition())
+		}
+		if err != nil {
+			return err
+		}
+		var unknown []error
+		for _, key := range meta.Undecoded() {
+			unknown = append(unknown, fmt.Errorf("%s: unknown setting", key))
+		}
+		if len(unknown) > 0 {
+			return errors.Join(unknown...)
+		}
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	// Apply Configuration
+	theme := THEME_DIRECTORY
+	if c.Theme.Directory != "" {
+		theme = c.Theme.Directory
+	}
+	if config.Load() == nil || theme != resourcesTheme() {
+		ResourcesLoad(theme)
+	}
+	config.Store(&c)
+	ConfigVersion.Add(1)
+	return nil
+}
+
+func (c *ConfigRoot) validate() error {
+	var errs []error
+	check := func(ok bool, key, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+		}
+	}
+	l := &c.Limits
+	check(l.MaxUploadBytes >= 1<<10 && l.MaxUploadBytes <= 1<<28,
+		"limits.max_upload_bytes", "must be between 1KiB and 256MiB, got %d", l.MaxUploadBytes)
+	check(l.MinDimension >= 1,
+		"limits.min_dimension", "must be at least 1, got %d", l.MinDimension)
+	check(l.MaxDimension >= l.MinDimension && l.MaxDimension <= 8192,
+		"limits.max_dimension", "must be between min_dimension and 8192, got %d", l.MaxDimension)
+	check(l.MaxMessageBytes >= 0 && l.MaxMessageBytes <= 1<<16,
+		"limits.max_message_bytes", "must be between 0 and 65536, got %d", l.MaxMessageBytes)
+	check(l.MaxNameBytes >= 1 && l.MaxNameBytes <= 1<<10,
+		"limits.max_name_bytes", "must be between 1 and 1024, got %d", l.MaxNameBytes)
+	check(l.MaxURLBytes >= 1 && l.MaxURLBytes <= 1<<13,
+		"limits.max_url_bytes", "must be between 1 and 8192, got %d", l.MaxURLBytes)
+	check(l.EditWindow >= 0 && l.EditWindow <= 7*24*time.Hour,
+		"limits.edit_window", "must be between 0s and 168h, got %s", l.EditWindow)
+	check(l.MaxDuplicates >= 0,
+		"limits.max_duplicates", "must be at least 0, got %d", l.MaxDuplicates)
+	check(c.Moderation.Threshold > 0 && c.Moderation.Threshold <= 1,
+		"moderation.threshold", "must be greater than 0 and at most 1, got %g", c.Moderation.Threshold)
+	m := &c.Moderation
+	check(m.BlockDistance >= -1 && m.BlockDistance <= 32,
+		"moderation.block_distance", "must be between -1 and 32, got %d", m.BlockDistance)
+	check(m.RescanAction == RESCAN_HIDE || m.RescanAction == RESCAN_FLAG,
+		"moderation.rescan_action", "must be hide or flag, got %q", m.RescanAction)
+	check(m.Composite == COMPOSITE_OFF || m.Composite == COMPOSITE_REJECT || m.Composite == COMPOSITE_REVIEW,
+		"moderation.composite", "must be off, reject or review, got %q", m.Composite)
+	check(m.TextThreshold >= 0 && m.TextThreshold <= 1,
+		"moderation.text_threshold", "must be between 0 and 1, got %g", m.TextThreshold)
+	check(len(m.Backgrounds) > 0,
+		"moderation.backgrounds", "must contain at least one background")
+	for i, name := range m.Backgrounds {
+		_, ok := modelBackgrounds[name]
+		check(ok, fmt.Sprintf("moderation.backgrounds[%d]", i), "must be black, white, checker or board, got %q", name)
+	}
+	for i, word := range m.DenyWords {
+		folded := TextFold(word)
+		check(folded != "", fmt.Sprintf("moderation.deny_words[%d]", i), "must contain a letter or number")
+		m.denyWords = append(m.denyWords, folded)
+	}
+	for i, pattern := range m.DenyPatterns {
+		compiled, err := regexp.Compile("(?i)" + pattern)
+		check(err == nil, fmt.Sprintf("moderation.deny_patterns[%d]", i), "%v", err)
+		m.denyPatterns = append(m.denyPatterns, compiled)
+	}
+	for key, domains := range map[string][]string{
+		"links.allow_domains": c.Links.AllowDomains,
+		"links.deny_domains":  c.Links.DenyDomains,
+	} {
+		for i := range domains {
+			normalized, err := urlDomainNormalize(domains[i])
+			check(err == nil && normalized != "", fmt.Sprintf("%s[%d]", key, i), "invalid domain: %q", domains[i])
+			domains[i] = normalized
+		}
+	}
+	if c.Theme.Directory != "" {
+		stat, err := os.Stat(c.Theme.Directory)
+		check(err == nil && stat.IsDir(),
+			"theme.directory", "must be an existing directory: %s", c.Theme.Directory)
+	}
+	for i := range c.Bans {
+		prefix, err := parseBanPrefix(c.Bans[i].CIDR)
+		check(err == nil, fmt.Sprintf("bans[%d].cidr", i), "invalid address range: %q", c.Bans[i].CIDR)
+		if err == nil {
+			c.Bans[i].CIDR = prefix.String()
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -2,61 +2,83 @@ package env
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"path"
+	"runtime"
 	"strconv"
+	"strings"
 )
 
 const (
-	MAX_FORM_BYTES        = 1 << 24
 	FILE_MODE             = os.FileMode(0770)
 	STICKERBOARD_FILENAME = "stickerboard.webp"
+	BACKGROUND_FILENAME   = "background.png"
+	TEMP_PREFIX           = ".tmp-" // Prefix for Temporary Files within DATA_DIRECTORY
 )
 
 var (
-	HTTP_TLS          *tls.Config                                   // http: TLS Configuration
-	HTTP_PROXY_HEADER = envString("HTTP_PROXY_HEADER", "")          // http: Retrieve IP Address from Following HTTP Header
-	HTTP_ADDRESS      = envString("HTTP_ADDRESS", "localhost:8080") // http: Address to Listen for Requests on
-	TLS_ENABLED       = envString("TLS_ENABLED", "false") == "true" // http: Enable TLS?
-	TLS_CERT          = envString("TLS_CERT", "tls_crt.pem")        // http: Path to TLS Certificate
-	TLS_KEY           = envString("TLS_KEY", "tls_key.pem")         // http: Path to TLS Key
-	TLS_CA            = envString("TLS_CA", "tls_ca.pem")           // http: Path to TLS CA Bundle
-	DATA_DIRECTORY    = envString("DATA_DIRECTORY", "data")         // env: Data Directory
+	HTTP_TLS                 *tls.Config                                                        // http: TLS Configuration
+	HTTP_PROXY_HEADER        = envString("HTTP_PROXY_HEADER", "")                               // http: Retrieve IP Address from Following HTTP Header
+	HTTP_ADDRESS             = envPath("HTTP_ADDRESS", "localhost:8080")                        // http: Address to Listen for Requests on
+	HTTP_REDIRECT_ADDRESS    = envString("HTTP_REDIRECT_ADDRESS", "")                           // http: Address to Redirect Plain HTTP to HTTPS on (optional)
+	HTTP_SOCKET              = envString("HTTP_SOCKET", "")                                     // http: Path to Unix Socket to Listen for Requests on (optional)
+	HTTP_SOCKET_MODE         = envFileMode("HTTP_SOCKET_MODE", 0660)                            // http: Permissions of Unix Socket
+	HTTP_ADMIN_ADDRESS       = envString("HTTP_ADMIN_ADDRESS", "")                              // http: Address to Serve Health and Metrics on (optional)
+	TLS_ENABLED              = envString("TLS_ENABLED", "false") == "true"                      // http: Enable TLS?
+	TLS_CERT                 = envString("TLS_CERT", "tls_crt.pem")                             // http: Path to TLS Certificate
+	TLS_KEY                  = envString("TLS_KEY", "tls_key.pem")                              // http: Path to TLS Key
+	TLS_CA                   = envString("TLS_CA", "")                                          // http: Path to TLS CA Bundle (optional)
+	TLS_CLIENT_AUTH          = envString("TLS_CLIENT_AUTH", "none")                             // http: Client Certificate Mode (none, request, require)
+	TLS_MIN_VERSION          = envString("TLS_MIN_VERSION", "1.3")                              // http: Minimum TLS Version (1.2, 1.3)
+	CONFIG_FILE              = envString("CONFIG_FILE", "")                                     // env: Path to Config File (optional)
+	DATA_DIRECTORY           = envString("DATA_DIRECTORY", "data")                              // env: Data Directory
+	THEME_DIRECTORY          = envString("THEME_DIRECTORY", "")                                 // env: Directory of Files Overriding the Embedded Theme
+	MODEL_DIRECTORY          = envString("MODEL_DIRECTORY", "resources/model")                  // env: Path to Tensorflow SavedModel
+	INTEGRITY_STARTUP        = envString("INTEGRITY_STARTUP", "false") == "true"                // integrity: Check Data Directory on Startup?
+	INTEGRITY_INTERVAL       = envNumber("INTEGRITY_INTERVAL", 0)                               // integrity: Minutes between Checks (0 to disable)
+	INTEGRITY_REMOVE_ORPHANS = envString("INTEGRITY_REMOVE_ORPHANS", "false") == "true"         // integrity: Delete Unreferenced Files?
+	INTEGRITY_QUARANTINE     = envString("INTEGRITY_QUARANTINE", "false") == "true"             // integrity: Hide Stickers with Broken Images?
+	WORKER_LIMIT             = envNumber("WORKER_LIMIT", runtime.NumCPU())                      // env: Maximum Threads used for Rendering and Moderation
+	ADMIN_SOCKET             = envPath("ADMIN_SOCKET", path.Join(DATA_DIRECTORY, "admin.sock")) // admin: Path to Admin Socket
+	LOG_FORMAT               = envString("LOG_FORMAT", "text")                                  // log: Output Format (text, json)
+	LOG_LEVEL                = envString("LOG_LEVEL", "info")                                   // log: Minimum Level (debug, info, warn, error)
+	TEMPLATE_RELOAD          = envString("TEMPLATE_RELOAD", "false") == "true"                  // dev: Reload Templates when Modified on Disk?
 )
 
 func init() {
+	// Setup Logging
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(LOG_LEVEL)); err != nil {
+		LogFatal("[env/log] Invalid Log Level", "level", LOG_LEVEL)
+	}
+	options := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(LOG_FORMAT) {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, options)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, options)))
+	default:
+		LogFatal("[env/log] Invalid Log Format", "format", LOG_FORMAT)
+	}
+
 	// Create Data Directory
 	if err := os.MkdirAll(DATA_DIRECTORY, FILE_MODE); err != nil {
-		log.Fatalln("[env/data] Create Directory Error:", err)
+		LogFatal("[env/data] Create Directory Error", "error", err)
+	}
+
+	// Load Config File (if any)
+	if err := ConfigLoad(); err != nil {
+		LogFatal("[env/config] Invalid Config File", "path", CONFIG_FILE, "error", err)
 	}
 
 	// Load and Parse TLS Configuration from Disk
 	if TLS_ENABLED {
-		cert, err := tls.LoadX509KeyPair(TLS_CERT, TLS_KEY)
-		if err != nil {
-			log.Fatalln("[env/tls] Cannot Load Keypair", err)
-		}
-		caBytes, err := os.ReadFile(TLS_CA)
+		tlsConfig, err := tlsSetup()
 		if err != nil {
-			log.Fatalln("[env/tls] Cannot Read CA File", err)
-		}
-		caPool := x509.NewCertPool()
-		if !caPool.AppendCertsFromPEM(caBytes) {
-			log.Fatalln("[env/tls] Cannot Append Certificates")
-		}
-		HTTP_TLS = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			ClientCAs:    caPool,
-			MinVersion:   tls.VersionTLS13,
-			MaxVersion:   tls.VersionTLS13,
-			CipherSuites: []uint16{
-				tls.TLS_AES_128_GCM_SHA256,
-				tls.TLS_AES_256_GCM_SHA384,
-				tls.TLS_CHACHA20_POLY1305_SHA256,
-			},
+			LogFatal("[env/tls] Invalid TLS Configuration", "error", err)
 		}
+		HTTP_TLS = tlsConfig
 	}
 }
 
@@ -65,7 +87,7 @@ func envString(key, defaultValue string) string {
 	systemValue := os.Getenv(key)
 	if systemValue == "" {
 		if defaultValue == "\x00" {
-			fmt.Printf("[env] Environment Variable '%s' is undefined\n", key)
+			slog.Error("[env] Environment Variable is undefined", "key", key)
 			os.Exit(2)
 		}
 		return defaultValue
@@ -73,6 +95,29 @@ func envString(key, defaultValue string) string {
 	return systemValue
 }
 
+// Reads Optional Path or Address from Environment, the value "none" disables it
+func envPath(key, defaultValue string) string {
+	v := envString(key, defaultValue)
+	if v == "none" {
+		return ""
+	}
+	return v
+}
+
+// Read Octal File Permissions from Environment
+func envFileMode(key string, defaultValue os.FileMode) os.FileMode {
+	systemValue := os.Getenv(key)
+	if systemValue == "" {
+		return defaultValue
+	}
+	v, err := strconv.ParseUint(systemValue, 8, 32)
+	if err != nil || v > 0777 {
+		slog.Error("[env] Environment Variable is not a octal file mode", "key", key, "value", systemValue)
+		os.Exit(2)
+	}
+	return os.FileMode(v)
+}
+
 // Read Number from Environment
 func envNumber(key string, defaultValue int) int {
 	systemValue := os.Getenv(key)
@@ -81,8 +126,14 @@ func envNumber(key string, defaultValue int) int {
 	}
 	v, err := strconv.Atoi(systemValue)
 	if err != nil {
-		fmt.Printf("[env] Environment Variable '%s' is not a integer: %s\n", key, err)
+		slog.Error("[env] Environment Variable is not a integer", "key", key, "error", err)
 		os.Exit(2)
 	}
 	return v
 }
+
+// Log an Error then Exit, slog has no equivalent to log.Fatal
+func LogFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
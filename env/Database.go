@@ -2,56 +2,95 @@ package env
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
+	"net/netip"
 	"os"
 	"path"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type DatabaseRoot struct {
-	Stickers []DatabaseSticker `json:"stickers"`
+	Sequence  int               `json:"sequence"` // Last Assigned Sticker ID
+	Stickers  []DatabaseSticker `json:"stickers"`
+	Bans      []DatabaseBan     `json:"bans"`
+	Blocklist []DatabaseBlock   `json:"blocklist"`
 }
 
 type DatabaseSticker struct {
-	Created     time.Time `json:"created"`      // Sticker Created
-	UserAddress string    `json:"user_address"` // User IP Address (For Manual Bans)
-	UserName    string    `json:"user_name"`    // User Name
-	UserURL     string    `json:"user_url"`     // User URL (Optional)
-	Message     string    `json:"message"`      // Sticker Message
-	Visible     bool      `json:"visible"`      // Sticker Visible?
-	OffsetX     int       `json:"offset_x"`     // Placement X
-	OffsetY     int       `json:"offset_y"`     // Placement Y
-	ImageScale  float64   `json:"image_scale"`  // Image Scale
-	ImageHeight int       `json:"image_height"` // Image Height
-	ImageWidth  int       `json:"image_width"`  // Image Width
-	ImageType   ImageType `json:"image_type"`   // Original Image File Type
-	ImageHash   string    `json:"image_hash"`   // Original Image File Hash
+	ID          int              `json:"id"`                     // Sticker ID
+	Created     time.Time        `json:"created"`                // Sticker Created
+	UserAddress string           `json:"user_address"`           // User IP Address (For Manual Bans)
+	UserName    string           `json:"user_name"`              // User Name
+	UserURL     string           `json:"user_url"`               // User URL (Optional)
+	Message     string           `json:"message"`                // Sticker Message
+	Visible     bool             `json:"visible"`                // Sticker Visible?
+	OffsetX     int              `json:"offset_x"`               // Placement X
+	OffsetY     int              `json:"offset_y"`               // Placement Y
+	ImageScale  float64          `json:"image_scale"`            // Image Scale
+	ImageHeight int              `json:"image_height"`           // Image Height
+	ImageWidth  int              `json:"image_width"`            // Image Width
+	ImageType   ImageType        `json:"image_type"`             // Original Image File Type
+	ImageHash   string           `json:"image_hash"`             // Original Image File Hash
+	Broken      string           `json:"broken,omitempty"`       // Reason the Sticker cannot be Rendered (if any)
+	EditToken   string           `json:"edit_token,omitempty"`   // Hash of the Secret allowing it's Author to make Changes
+	ImageHashes []PerceptualHash `json:"image_hashes,omitempty"` // Perceptual Hash of each Frame
+	Flagged     string           `json:"flagged,omitempty"`      // Reason the Sticker needs Review (if any)
+	FlagScores  *ModelScores     `json:"flag_scores,omitempty"`  // Scores which led to the Flag (if any)
 }
 
+// Images similar to a removed Sticker are refused
+type DatabaseBlock struct {
+	Created   time.Time      `json:"created"`    // Block Created
+	Hash      PerceptualHash `json:"hash"`       // Perceptual Hash of a Removed Frame
+	StickerID int            `json:"sticker_id"` // Sticker the Hash was taken from
+	Reason    string         `json:"reason"`     // Block Reason (Optional)
+}
+
+type DatabaseBan struct {
+	Created time.Time `json:"created"` // Ban Created
+	CIDR    string    `json:"cidr"`    // Banned Address Range
+	Reason  string    `json:"reason"`  // Ban Reason (Optional)
+}
+
+var (
+	Database      DatabaseRoot
+	DatabaseMtx   sync.RWMutex
+	DatabasePath  = path.Join(DATA_DIRECTORY, "database.json")
+	DatabaseReady = NewSignal()
+	// Held by whichever process owns the Data Directory, see DatabaseLock
+	DatabaseLockPath = path.Join(DATA_DIRECTORY, "database.lock")
+	databaseLock     *os.File
+	// Incremented whenever Stickers are modified so derived data can be cached
+	DatabaseVersion atomic.Uint64
+)
+
 var (
-	Database    DatabaseRoot
-	DatabaseMtx sync.RWMutex
+	ErrStickerNotFound = errors.New("sticker not found")
+	ErrBanNotFound     = errors.New("ban not found")
+	ErrBlockNotFound   = errors.New("blocklist entry not found")
+	ErrEditDenied      = errors.New("invalid edit token")
+	ErrEditExpired     = errors.New("edit window has passed")
+	ErrDatabaseLocked  = errors.New("data directory is in use by another process")
 )
 
 func SetupDatabase(stop context.Context, await *sync.WaitGroup) {
 	t := time.Now()
-	p := path.Join(DATA_DIRECTORY, "database.json")
-
-	// Decode File
-	b, err := os.ReadFile(p)
-	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			log.Fatalln("[db] Read Database Error:", err)
-		}
-		Database.Stickers = make([]DatabaseSticker, 0)
+	if err := DatabaseLock(); err != nil {
+		LogFatal("[db] Cannot Lock Data Directory, is another instance running?", "path", DatabaseLockPath, "error", err)
 	}
-	if err == nil {
-		if err := json.Unmarshal(b, &Database); err != nil {
-			log.Fatalln("[db] Parse Database Error:", err)
-		}
+	if err := DatabaseLoad(); err != nil {
+		LogFatal("[db] Load Database Error", "error", err)
 	}
 
 	// Shutdown Logic
@@ -59,17 +98,240 @@ func SetupDatabase(stop context.Context, await *sync.WaitGroup) {
 	go func() {
 		defer await.Done()
 		<-stop.Done()
+		StickerboardAwait()
+		if err := DatabaseSave(); err != nil {
+			LogFatal("[db] Cannot Save Database", "error", err)
+		}
+		slog.Info("[db] Database Saved")
+	}()
+
+	DatabaseReady.Set()
+	slog.Info("[db] Database Ready", "stickers", len(Database.Stickers), "took", time.Since(t))
+}
+
+// Take an exclusive Lock on the Data Directory until the process exits. Both
+// the server and admin commands run without it hold the lock, otherwise each
+// would save over the other's changes. The lock is released by the operating
+// system when the process exits, so a crash never leaves it behind.
+func DatabaseLock() error {
+	if databaseLock != nil {
+		return nil
+	}
+	f, err := databaseLockFile(DatabaseLockPath)
+	if err != nil {
+		return err
+	}
+	databaseLock = f
+	return nil
+}
 
-		// Write Database To Disk
-		b, err := json.MarshalIndent(&Database, "", "    ")
-		if err != nil {
-			log.Fatalln("[db] Cannot Marshal Database:", err)
+// Read the Database from Disk, assigning IDs to any stickers that predate them
+func DatabaseLoad() error {
+	DatabaseMtx.Lock()
+	defer DatabaseMtx.Unlock()
+
+	// Decode File
+	b, err := os.ReadFile(DatabasePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &Database); err != nil {
+			return err
+		}
+	}
+	if Database.Stickers == nil {
+		Database.Stickers = make([]DatabaseSticker, 0)
+	}
+	if Database.Bans == nil {
+		Database.Bans = make([]DatabaseBan, 0)
+	}
+	if Database.Blocklist == nil {
+		Database.Blocklist = make([]DatabaseBlock, 0)
+	}
+
+	// Migrate Stickers without an ID
+	for i := range Database.Stickers {
+		Database.Sequence = max(Database.Sequence, Database.Stickers[i].ID)
+	}
+	for i := range Database.Stickers {
+		if Database.Stickers[i].ID == 0 {
+			Database.Stickers[i].ID = DatabaseNextID()
 		}
-		if err := os.WriteFile(p, b, FILE_MODE); err != nil {
-			log.Fatalln("[db] Cannot Write Database:", err)
+	}
+	DatabaseVersion.Add(1)
+	return nil
+}
+
+// Write the Database to Disk
+func DatabaseSave() error {
+	DatabaseMtx.RLock()
+	b, err := json.MarshalIndent(&Database, "", "    ")
+	DatabaseMtx.RUnlock()
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(DatabasePath, b)
+}
+
+// Reserve the next Sticker ID, must be called with DatabaseMtx held
+func DatabaseNextID() int {
+	Database.Sequence++
+	return Database.Sequence
+}
+
+// Find the index of a Sticker by ID, must be called with DatabaseMtx held
+func DatabaseFind(id int) (int, error) {
+	for i := range Database.Stickers {
+		if Database.Stickers[i].ID == id {
+			return i, nil
 		}
-		log.Println("[db] Database Saved")
-	}()
+	}
+	return -1, ErrStickerNotFound
+}
+
+// Count the Visible Stickers using the given Image File, must be called with DatabaseMtx held
+func DatabaseCountImage(hash string) int {
+	n := 0
+	for _, s := range Database.Stickers {
+		if s.Visible && s.ImageHash == hash {
+			n++
+		}
+	}
+	return n
+}
+
+// Generate a Secret Edit Token for a new Sticker, only it's hash should be stored
+func DatabaseEditToken() (token, hash string) {
+	var b [24]byte
+	rand.Read(b[:])
+	token = base64.RawURLEncoding.EncodeToString(b[:])
+	return token, databaseHashToken(token)
+}
+
+func databaseHashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Check the Author may still change the Sticker at the given index, must be
+// called with DatabaseMtx held
+func DatabaseEditAllowed(i int, token string) error {
+	s := &Database.Stickers[i]
+	if s.EditToken == "" || token == "" ||
+		subtle.ConstantTimeCompare([]byte(s.EditToken), []byte(databaseHashToken(token))) != 1 {
+		return ErrEditDenied
+	}
+	if time.Since(s.Created) > Config().Limits.EditWindow {
+		return ErrEditExpired
+	}
+	return nil
+}
+
+// Returns the Ban covering the given address (if any), including those from the Config File
+func DatabaseBanned(address string) (DatabaseBan, bool) {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return DatabaseBan{}, false
+	}
+	addr = addr.Unmap()
+
+	for _, ban := range Config().Bans {
+		if prefix, err := netip.ParsePrefix(ban.CIDR); err == nil && prefix.Contains(addr) {
+			return DatabaseBan{CIDR: ban.CIDR, Reason: ban.Reason}, true
+		}
+	}
+
+	DatabaseMtx.RLock()
+	defer DatabaseMtx.RUnlock()
+	for _, ban := range Database.Bans {
+		if prefix, err := netip.ParsePrefix(ban.CIDR); err == nil && prefix.Contains(addr) {
+			return ban, true
+		}
+	}
+	return DatabaseBan{}, false
+}
+
+// Show or Hide a Sticker, showing a sticker also clears it's broken and
+// flagged status so it will be attempted again during the next render
+func DatabaseSetVisible(id int, visible bool) error {
+	DatabaseMtx.Lock()
+	defer DatabaseMtx.Unlock()
+	i, err := DatabaseFind(id)
+	if err != nil {
+		return err
+	}
+	Database.Stickers[i].Visible = visible
+	if visible {
+		Database.Stickers[i].Broken = ""
+		Database.Stickers[i].Flagged = ""
+		Database.Stickers[i].FlagScores = nil
+	}
+	DatabaseVersion.Add(1)
+	return nil
+}
+
+// Remove a Sticker, it's image is left for the garbage collector as other
+// stickers may share it
+func DatabaseDelete(id int) error {
+	DatabaseMtx.Lock()
+	defer DatabaseMtx.Unlock()
+	i, err := DatabaseFind(id)
+	if err != nil {
+		return err
+	}
+	Database.Stickers = slices.Delete(Database.Stickers, i, i+1)
+	DatabaseVersion.Add(1)
+	return nil
+}
+
+// Ban an Address Range from Uploading, a single address may also be given
+func DatabaseBanAdd(cidr, reason string) (DatabaseBan, error) {
+	prefix, err := parseBanPrefix(cidr)
+	if err != nil {
+		return DatabaseBan{}, err
+	}
+	DatabaseMtx.Lock()
+	defer DatabaseMtx.Unlock()
+	for _, ban := range Database.Bans {
+		if ban.CIDR == prefix.String() {
+			return ban, nil
+		}
+	}
+	ban := DatabaseBan{
+		Created: time.Now(),
+		CIDR:    prefix.String(),
+		Reason:  reason,
+	}
+	Database.Bans = append(Database.Bans, ban)
+	return ban, nil
+}
+
+// Lift a Ban previously created with DatabaseBanAdd
+func DatabaseBanRemove(cidr string) error {
+	prefix, err := parseBanPrefix(cidr)
+	if err != nil {
+		return err
+	}
+	DatabaseMtx.Lock()
+	defer DatabaseMtx.Unlock()
+	for i, ban := range Database.Bans {
+		if ban.CIDR == prefix.String() {
+			Database.Bans = slices.Delete(Database.Bans, i, i+1)
+			return nil
+		}
+	}
+	return ErrBanNotFound
+}
 
-	log.Println("[db] Ready in", time.Since(t))
+func parseBanPrefix(cidr string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(cidr); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address range: %s", cidr)
+	}
+	return prefix.Masked(), nil
 }
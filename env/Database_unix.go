@@ -0,0 +1,25 @@
+//go:build unix
+
+package env
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Open and flock the Lock File, failing immediately if another process holds it
+func databaseLockFile(lockPath string) (*os.File, error) {
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, FILE_MODE)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrDatabaseLocked
+		}
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,29 @@
+//go:build windows
+
+package env
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const errorSharingViolation = syscall.Errno(32) // ERROR_SHARING_VIOLATION
+
+// Open the Lock File without sharing, so no other process can open it until
+// this one exits
+func databaseLockFile(lockPath string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(lockPath)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+		syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if errors.Is(err, errorSharingViolation) {
+		return nil, ErrDatabaseLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(h), lockPath), nil
+}
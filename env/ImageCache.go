@@ -0,0 +1,63 @@
+package env
+
+import (
+	"container/list"
+	"image"
+	"sync"
+)
+
+const IMAGE_CACHE_BYTES = 64 << 20 // Approximate Memory used by Decoded Images kept for Duplicate Uploads
+
+// Work done on an Uploaded Image, kept so identical uploads can skip it
+type ImageCacheEntry struct {
+	Frames []image.Image    // Decoded Frames, do not modify
+	Hashes []PerceptualHash // Perceptual Hash of each Frame
+	hash   string           // SHA-1 of the Image File
+	bytes  int              // Approximate Size of Frames
+}
+
+var (
+	imageCacheMtx   sync.Mutex
+	imageCacheList  = list.New() // Most Recently Used First
+	imageCacheIndex = make(map[string]*list.Element)
+	imageCacheBytes int
+)
+
+// Retrieve the Cached Work for an Image by it's file hash (if any)
+func ImageCacheGet(hash string) (*ImageCacheEntry, bool) {
+	imageCacheMtx.Lock()
+	defer imageCacheMtx.Unlock()
+	e, ok := imageCacheIndex[hash]
+	if !ok {
+		return nil, false
+	}
+	imageCacheList.MoveToFront(e)
+	return e.Value.(*ImageCacheEntry), true
+}
+
+// Store the Work done on an Image, evicting the least recently used images
+// once the cache is full. Images too large to fit are not cached.
+func ImageCachePut(hash string, entry *ImageCacheEntry) {
+	entry.hash = hash
+	entry.bytes = 0
+	for _, f := range entry.Frames {
+		entry.bytes += f.Bounds().Dx() * f.Bounds().Dy() * 4
+	}
+	if entry.bytes > IMAGE_CACHE_BYTES {
+		return
+	}
+
+	imageCacheMtx.Lock()
+	defer imageCacheMtx.Unlock()
+	if e, ok := imageCacheIndex[hash]; ok {
+		imageCacheBytes -= e.Value.(*ImageCacheEntry).bytes
+		imageCacheList.Remove(e)
+	}
+	imageCacheIndex[hash] = imageCacheList.PushFront(entry)
+	imageCacheBytes += entry.bytes
+	for imageCacheBytes > IMAGE_CACHE_BYTES {
+		oldest := imageCacheList.Remove(imageCacheList.Back()).(*ImageCacheEntry)
+		delete(imageCacheIndex, oldest.hash)
+		imageCacheBytes -= oldest.bytes
+	}
+}
@@ -0,0 +1,231 @@
+package env
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	INTEGRITY_GRACE       = time.Hour    // Minimum age before an unreferenced file is considered an orphan
+	QUARANTINE_DIRECTORY  = "quarantine" // Directory within DATA_DIRECTORY broken images are moved to
+	PROBLEM_MISSING       = "missing"    // Sticker Image does not exist
+	PROBLEM_HASH_MISMATCH = "mismatch"   // Sticker Image does not match it's hash
+	PROBLEM_UNREADABLE    = "unreadable" // Sticker Image could not be read
+)
+
+var integrityImageName = regexp.MustCompile(`^[0-9A-F]{40}$`)
+
+type IntegrityOptions struct {
+	RemoveOrphans bool `json:"remove_orphans"` // Delete files not referenced by any sticker?
+	Quarantine    bool `json:"quarantine"`     // Hide stickers with broken images and move the images aside?
+}
+
+// A Sticker whose Image is missing or does not match it's hash
+type IntegrityProblem struct {
+	ID      int    `json:"id"`      // Sticker ID
+	Hash    string `json:"hash"`    // Expected Image Hash
+	Problem string `json:"problem"` // Kind of Problem
+	Detail  string `json:"detail"`  // Description of Problem
+}
+
+type IntegrityReport struct {
+	Checked     int                `json:"checked"`     // Stickers Checked
+	Problems    []IntegrityProblem `json:"problems"`    // Stickers with Broken Images
+	Orphans     []string           `json:"orphans"`     // Files not referenced by any Sticker
+	Removed     []string           `json:"removed"`     // Orphans that were deleted
+	Quarantined []int              `json:"quarantined"` // Stickers that were hidden
+}
+
+func SetupIntegrity(stop context.Context, await *sync.WaitGroup) {
+	options := IntegrityOptions{
+		RemoveOrphans: INTEGRITY_REMOVE_ORPHANS,
+		Quarantine:    INTEGRITY_QUARANTINE,
+	}
+	if INTEGRITY_STARTUP {
+		integrityScheduled(options)
+	}
+	if INTEGRITY_INTERVAL <= 0 {
+		return
+	}
+
+	// Scheduled Checks
+	await.Add(1)
+	go func() {
+		defer await.Done()
+		t := time.NewTicker(time.Duration(INTEGRITY_INTERVAL) * time.Minute)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop.Done():
+				return
+			case <-t.C:
+				if integrityScheduled(options) {
+					StickerboardQueue()
+				}
+			}
+		}
+	}()
+}
+
+// Run and Log an Integrity Check, returning true if any stickers were hidden
+func integrityScheduled(options IntegrityOptions) bool {
+	t := time.Now()
+	report, err := IntegrityRun(options)
+	if err != nil {
+		slog.Error("[integrity] Check Failed", "error", err)
+		return false
+	}
+	for _, p := range report.Problems {
+		slog.Warn("[integrity] Broken Sticker", "id", p.ID, "hash", p.Hash, "problem", p.Problem, "detail", p.Detail)
+	}
+	slog.Info("[integrity] Check Complete",
+		"checked", report.Checked,
+		"problems", len(report.Problems),
+		"orphans", len(report.Orphans),
+		"removed", len(report.Removed),
+		"quarantined", len(report.Quarantined),
+		"took", time.Since(t),
+	)
+	return len(report.Quarantined) > 0
+}
+
+// Check every Sticker references an intact Image and find files in the Data
+// Directory which are no longer referenced, optionally cleaning up both
+func IntegrityRun(options IntegrityOptions) (IntegrityReport, error) {
+	report := IntegrityReport{
+		Problems:    []IntegrityProblem{},
+		Orphans:     []string{},
+		Removed:     []string{},
+		Quarantined: []int{},
+	}
+
+	// Snapshot Database
+	DatabaseMtx.RLock()
+	records := make([]DatabaseSticker, len(Database.Stickers))
+	copy(records, Database.Stickers)
+	DatabaseMtx.RUnlock()
+	report.Checked = len(records)
+
+	// Check Images, each is only read once no matter how many stickers share it
+	referenced := make(map[string]bool)
+	broken := make(map[string]IntegrityProblem)
+	for _, s := range records {
+		if !referenced[s.ImageHash] {
+			referenced[s.ImageHash] = true
+			if problem, ok := integrityCheckImage(s.ImageHash); !ok {
+				broken[s.ImageHash] = problem
+			}
+		}
+		if problem, ok := broken[s.ImageHash]; ok {
+			problem.ID = s.ID
+			report.Problems = append(report.Problems, problem)
+		}
+	}
+
+	// Find Orphans
+	entries, err := os.ReadDir(DATA_DIRECTORY)
+	if err != nil {
+		return report, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		isImage := integrityImageName.MatchString(name)
+		isTemp := strings.HasPrefix(name, TEMP_PREFIX)
+		if e.IsDir() || (!isImage && !isTemp) || referenced[name] {
+			continue
+		}
+		// Recently written files may belong to an upload in progress
+		if info, err := e.Info(); err != nil || time.Since(info.ModTime()) < INTEGRITY_GRACE {
+			continue
+		}
+		if !options.RemoveOrphans {
+			report.Orphans = append(report.Orphans, name)
+			continue
+		}
+		removed, err := integrityRemoveOrphan(name)
+		if err != nil {
+			slog.Warn("[integrity] Cannot Remove Orphan", "name", name, "error", err)
+			report.Orphans = append(report.Orphans, name)
+			continue
+		}
+		if removed {
+			report.Orphans = append(report.Orphans, name)
+			report.Removed = append(report.Removed, name)
+		}
+	}
+
+	// Quarantine Broken Stickers
+	if options.Quarantine && len(broken) > 0 {
+		quarantine := path.Join(DATA_DIRECTORY, QUARANTINE_DIRECTORY)
+		if err := os.MkdirAll(quarantine, FILE_MODE); err != nil {
+			return report, err
+		}
+		for hash := range broken {
+			err := os.Rename(path.Join(DATA_DIRECTORY, hash), path.Join(quarantine, hash))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return report, err
+			}
+		}
+		DatabaseMtx.Lock()
+		for _, p := range report.Problems {
+			i, err := DatabaseFind(p.ID)
+			if err != nil {
+				continue
+			}
+			s := &Database.Stickers[i]
+			s.Broken = p.Problem
+			if s.Visible {
+				s.Visible = false
+				report.Quarantined = append(report.Quarantined, s.ID)
+			}
+		}
+		DatabaseVersion.Add(1)
+		DatabaseMtx.Unlock()
+	}
+
+	return report, nil
+}
+
+// Remove an Orphan unless it was referenced or reused since the snapshot was
+// taken. Uploads reusing an existing file touch it while holding DatabaseMtx,
+// so holding it here means the file is either seen as recent or already gone.
+func integrityRemoveOrphan(name string) (bool, error) {
+	DatabaseMtx.Lock()
+	defer DatabaseMtx.Unlock()
+	if slices.ContainsFunc(Database.Stickers, func(s DatabaseSticker) bool { return s.ImageHash == name }) {
+		return false, nil
+	}
+	filePath := path.Join(DATA_DIRECTORY, name)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return false, err
+	}
+	if time.Since(info.ModTime()) < INTEGRITY_GRACE {
+		return false, nil
+	}
+	return true, os.Remove(filePath)
+}
+
+func integrityCheckImage(hash string) (IntegrityProblem, bool) {
+	b, err := os.ReadFile(path.Join(DATA_DIRECTORY, hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return IntegrityProblem{Hash: hash, Problem: PROBLEM_MISSING, Detail: "image file does not exist"}, false
+	}
+	if err != nil {
+		return IntegrityProblem{Hash: hash, Problem: PROBLEM_UNREADABLE, Detail: err.Error()}, false
+	}
+	if h := fmt.Sprintf("%X", sha1.Sum(b)); h != hash {
+		return IntegrityProblem{Hash: hash, Problem: PROBLEM_HASH_MISMATCH, Detail: "image hash is " + h}, false
+	}
+	return IntegrityProblem{}, true
+}
@@ -0,0 +1,33 @@
+package env
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+const (
+	SYSTEMD_FD_START  = 3          // First File Descriptor passed by systemd
+	LISTENER_PUBLIC   = "public"   // Serves the Website
+	LISTENER_ADMIN    = "admin"    // Serves Health and Metrics
+	LISTENER_REDIRECT = "redirect" // Redirects Plain HTTP to HTTPS
+)
+
+// Listen on a Unix Socket with the given permissions, refusing to start if
+// another process is already using it but replacing one left behind by a crash
+func ListenUnix(socketPath string, mode os.FileMode) (net.Listener, error) {
+	if c, err := net.Dial("unix", socketPath); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("socket in use, is another instance running? %s", socketPath)
+	}
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package env
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// Socket activation relies on inheriting file descriptors, which is only
+// possible on unix systems
+func ListenSystemd() (map[string][]net.Listener, error) {
+	if os.Getenv("LISTEN_FDS") == "" {
+		return nil, nil
+	}
+	return nil, errors.New("socket activation is not supported on this platform")
+}
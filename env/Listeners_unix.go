@@ -0,0 +1,49 @@
+//go:build unix
+
+package env
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Collect Listeners passed to us through systemd socket activation, grouped by
+// their FileDescriptorName. Unrecognized names are served as the website.
+func ListenSystemd() (map[string][]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// Prevent Children from Inheriting the Sockets
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make(map[string][]net.Listener)
+	for i := 0; i < count; i++ {
+		fd := SYSTEMD_FD_START + i
+		syscall.CloseOnExec(fd)
+		name := LISTENER_PUBLIC
+		if i < len(names) && (names[i] == LISTENER_ADMIN || names[i] == LISTENER_REDIRECT) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("systemd:%d", fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("file descriptor %d: %w", fd, err)
+		}
+		listeners[name] = append(listeners[name], l)
+	}
+	return listeners, nil
+}
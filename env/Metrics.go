@@ -0,0 +1,210 @@
+package env
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are written by hand in the Prometheus text exposition format
+// 	https://prometheus.io/docs/instrumenting/exposition_formats/
+
+const (
+	UPLOAD_RATE_LIMITED = "rate_limited" // Uploader posted too recently
+	UPLOAD_BANNED       = "banned"       // Uploader address is banned
+	UPLOAD_TOO_LARGE    = "too_large"    // Payload or image dimensions too large
+	UPLOAD_TOO_SMALL    = "too_small"    // Image dimensions too small
+	UPLOAD_BAD_FORMAT   = "bad_format"   // Unsupported or undecodable image
+	UPLOAD_INVALID      = "invalid"      // Malformed form or placement
+	UPLOAD_REJECTED     = "rejected"     // Rejected by the model
+	UPLOAD_BLOCKED      = "blocked"      // Similar to a sticker removed as abusive
+	UPLOAD_DUPLICATE    = "duplicate"    // Image already appears on the board too many times
+	UPLOAD_TEXT_DENIED  = "text_denied"  // Name, URL or Message refused by text moderation
+	UPLOAD_REVIEW       = "review"       // Sticker was posted but held for review
+	UPLOAD_ACCEPTED     = "accepted"     // Sticker was posted
+	UPLOAD_ERROR        = "error"        // Internal server error
+)
+
+var (
+	MetricUploads = &MetricCounter{
+		Name:  "stickerboard_uploads_total",
+		Help:  "Sticker uploads by outcome",
+		Label: "outcome",
+	}
+	MetricModelLatency = &MetricHistogram{
+		Name:    "stickerboard_model_inference_seconds",
+		Help:    "Time spent running a single model inference",
+		Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5},
+	}
+	MetricRenderDuration = &MetricHistogram{
+		Name:    "stickerboard_render_seconds",
+		Help:    "Time spent rendering the stickerboard",
+		Buckets: []float64{.5, 1, 2.5, 5, 10, 25, 50, 100},
+	}
+	MetricFFMPEGFailures = &MetricCounter{
+		Name: "stickerboard_ffmpeg_failures_total",
+		Help: "Renders where the ffmpeg encoder failed",
+	}
+	MetricStickers = &MetricGauge{
+		Name: "stickerboard_stickers",
+		Help: "Stickers stored in the database",
+		Func: func() float64 {
+			DatabaseMtx.RLock()
+			defer DatabaseMtx.RUnlock()
+			return float64(len(Database.Stickers))
+		},
+	}
+	MetricBrokenStickers = &MetricGauge{
+		Name: "stickerboard_broken_stickers",
+		Help: "Stickers which could not be rendered",
+		Func: func() float64 {
+			DatabaseMtx.RLock()
+			defer DatabaseMtx.RUnlock()
+			n := 0
+			for _, s := range Database.Stickers {
+				if s.Broken != "" {
+					n++
+				}
+			}
+			return float64(n)
+		},
+	}
+	MetricBoardBytes = &MetricGauge{
+		Name: "stickerboard_board_bytes",
+		Help: "Size of the latest rendered stickerboard in bytes",
+		Func: func() float64 {
+			StickerboardMtx.RLock()
+			defer StickerboardMtx.RUnlock()
+			return float64(len(Stickerboard))
+		},
+	}
+	metricsAll = []metric{
+		MetricUploads,
+		MetricModelLatency,
+		MetricRenderDuration,
+		MetricFFMPEGFailures,
+		MetricStickers,
+		MetricBrokenStickers,
+		MetricBoardBytes,
+	}
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// Write all Metrics to the given Writer
+func MetricsWrite(w io.Writer) {
+	for _, m := range metricsAll {
+		m.write(w)
+	}
+}
+
+// A monotonically increasing value, optionally partitioned by a single label
+type MetricCounter struct {
+	Name   string
+	Help   string
+	Label  string
+	mtx    sync.Mutex
+	values map[string]*atomic.Uint64
+}
+
+// Increment the Counter for the given label value, unlabeled counters should pass an empty string
+func (c *MetricCounter) Inc(labelValue string) {
+	c.mtx.Lock()
+	if c.values == nil {
+		c.values = make(map[string]*atomic.Uint64)
+	}
+	v, ok := c.values[labelValue]
+	if !ok {
+		v = new(atomic.Uint64)
+		c.values[labelValue] = v
+	}
+	c.mtx.Unlock()
+	v.Add(1)
+}
+
+func (c *MetricCounter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.Name, c.Help, c.Name)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.Label == "" {
+		var total uint64
+		for _, v := range c.values {
+			total += v.Load()
+		}
+		fmt.Fprintf(w, "%s %d\n", c.Name, total)
+		return
+	}
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.Name, c.Label, k, c.values[k].Load())
+	}
+}
+
+// A value sampled whenever metrics are collected
+type MetricGauge struct {
+	Name string
+	Help string
+	Func func() float64
+}
+
+func (g *MetricGauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.Name, g.Help, g.Name)
+	fmt.Fprintf(w, "%s %g\n", g.Name, g.Func())
+}
+
+// A distribution of observed values sorted into cumulative buckets
+type MetricHistogram struct {
+	Name    string
+	Help    string
+	Buckets []float64
+	mtx     sync.Mutex
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// Record a single observation
+func (h *MetricHistogram) Observe(v float64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(h.Buckets))
+	}
+	for i, b := range h.Buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Record the time elapsed since t in seconds
+func (h *MetricHistogram) ObserveSince(t time.Time) {
+	h.Observe(time.Since(t).Seconds())
+}
+
+func (h *MetricHistogram) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.Name, h.Help, h.Name)
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for i, b := range h.Buckets {
+		var c uint64
+		if h.counts != nil {
+			c = h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.Name, b, c)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.Name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", h.Name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", h.Name, h.count)
+}
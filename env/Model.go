@@ -2,8 +2,16 @@ package env
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"image"
-	"log"
+	"image/color"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -12,26 +20,95 @@ import (
 )
 
 const (
-	MODEL_TRESHOLD = 0.7 // Threshold before an image is considered inappropriate
-	MODEL_SIZE     = 224 // Model Size
+	MODEL_SIZE         = 224       // Model Size
+	MODEL_CHECKER_SIZE = 16        // Size of each Square in the Checkered Background
+	BACKGROUND_BLACK   = "black"   // Flatten Transparent Images onto Black
+	BACKGROUND_WHITE   = "white"   // Flatten Transparent Images onto White
+	BACKGROUND_CHECKER = "checker" // Flatten Transparent Images onto a Grey Checkerboard
+	BACKGROUND_BOARD   = "board"   // Flatten Transparent Images onto the Stickerboard Background
 )
 
-var nsfwModel *tf.SavedModel
+// Backgrounds Transparent Images are flattened onto before classification,
+// the board background is scaled whenever it's used as it may be replaced
+var modelBackgrounds = map[string]*image.RGBA{
+	BACKGROUND_BLACK:   modelUniform(color.RGBA{0, 0, 0, 255}),
+	BACKGROUND_WHITE:   modelUniform(color.RGBA{255, 255, 255, 255}),
+	BACKGROUND_CHECKER: modelChecker(color.RGBA{204, 204, 204, 255}, color.RGBA{255, 255, 255, 255}),
+	BACKGROUND_BOARD:   nil,
+}
 
-func SetupModel(stop context.Context, await *sync.WaitGroup) {
-	t := time.Now()
+func modelUniform(c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, MODEL_SIZE, MODEL_SIZE))
+	draw.Draw(img, img.Rect, image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
 
-	// Read Model from Disk
-	model, err := tf.LoadSavedModel("resources/model", []string{"serve"}, nil)
-	if err != nil {
-		log.Fatalf("[model] Unable to Load Model (%s)\n", err)
+func modelChecker(a, b color.RGBA) *image.RGBA {
+	img := modelUniform(a)
+	for y := 0; y < MODEL_SIZE; y++ {
+		for x := 0; x < MODEL_SIZE; x++ {
+			if (x/MODEL_CHECKER_SIZE+y/MODEL_CHECKER_SIZE)%2 == 1 {
+				img.SetRGBA(x, y, b)
+			}
+		}
 	}
-	nsfwModel = model
+	return img
+}
 
-	// Test Model using Dummy Tensor
-	dummy, _ := tf.NewTensor([1][MODEL_SIZE][MODEL_SIZE][3]float32{})
-	if _, err := ModelClassifyTensor(dummy); err != nil {
-		log.Fatalf("[model] Failed to Initialize Model (%s)\n", err)
+// Returns the Background with the given name, which must not be modified
+func modelBackground(name string) *image.RGBA {
+	if name != BACKGROUND_BOARD {
+		return modelBackgrounds[name]
+	}
+	img := image.NewRGBA(image.Rect(0, 0, MODEL_SIZE, MODEL_SIZE))
+	StickerboardMtx.RLock()
+	draw.BiLinear.Scale(img, img.Rect, StickerboardBack, StickerboardBack.Rect, draw.Src, nil)
+	StickerboardMtx.RUnlock()
+	return img
+}
+
+var (
+	nsfwModel    *tf.SavedModel
+	ModelReady   = NewSignal()
+	ModelVersion string // Checksum of the Model Files, changes whenever the model is replaced
+)
+
+// Model Predictions for each Category
+type ModelScores struct {
+	Drawing float32 `json:"drawing"`
+	Hentai  float32 `json:"hentai"`
+	Neutral float32 `json:"neutral"`
+	Porn    float32 `json:"porn"`
+	Sexy    float32 `json:"sexy"`
+	Text    float32 `json:"text"` // Estimated by ImageText rather than the Model
+}
+
+// Calculate How Inappropriate this Image is
+func (s ModelScores) Score() float32 {
+	return s.Hentai + s.Porn + (s.Sexy * 0.9)
+}
+
+// Returns true if the Image is considered safe
+func (s ModelScores) Safe() bool {
+	return float64(s.Score()) < Config().Moderation.Threshold
+}
+
+func (s ModelScores) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Float64("drawing", float64(s.Drawing)),
+		slog.Float64("hentai", float64(s.Hentai)),
+		slog.Float64("neutral", float64(s.Neutral)),
+		slog.Float64("porn", float64(s.Porn)),
+		slog.Float64("sexy", float64(s.Sexy)),
+		slog.Float64("text", float64(s.Text)),
+		slog.Float64("score", float64(s.Score())),
+	)
+}
+
+func SetupModel(stop context.Context, await *sync.WaitGroup) {
+	t := time.Now()
+	if err := ModelLoad(); err != nil {
+		LogFatal("[model] Unable to Load Model", "error", err)
 	}
 
 	// Shutdown Logic
@@ -40,14 +117,60 @@ func SetupModel(stop context.Context, await *sync.WaitGroup) {
 		defer await.Done()
 		<-stop.Done()
 		nsfwModel.Session.Close()
-		log.Println("[model] Model Closed")
+		slog.Info("[model] Model Closed")
 	}()
 
-	log.Printf("[model] Model Ready (%s)\n", time.Since(t))
+	slog.Info("[model] Model Ready", "version", ModelVersion, "took", time.Since(t))
+}
+
+// Read the Model from Disk and test it using a Dummy Tensor
+func ModelLoad() error {
+	version, err := modelChecksum(MODEL_DIRECTORY)
+	if err != nil {
+		return err
+	}
+	model, err := tf.LoadSavedModel(MODEL_DIRECTORY, []string{"serve"}, nil)
+	if err != nil {
+		return err
+	}
+	nsfwModel = model
+	ModelVersion = version
+
+	dummy, _ := tf.NewTensor([1][MODEL_SIZE][MODEL_SIZE][3]float32{})
+	if _, err := ModelClassifyTensor(dummy); err != nil {
+		nsfwModel.Session.Close()
+		return fmt.Errorf("model initialization failed: %w", err)
+	}
+	ModelReady.Set()
+	return nil
+}
+
+// Checksum every File in the Model Directory, in a stable order
+func modelChecksum(directory string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(directory, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rel, _ := filepath.Rel(directory, p)
+		fmt.Fprintf(h, "%s\x00", rel)
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
 }
 
 // Cast Predictions on a Tensor using the NSFW Model
 func ModelClassifyTensor(tensor *tf.Tensor) ([]float32, error) {
+	defer MetricModelLatency.ObserveSince(time.Now())
 	results, err := nsfwModel.Session.Run(
 		map[tf.Output]*tf.Tensor{
 			nsfwModel.Graph.Operation("serving_default_input").Output(0): tensor,
@@ -64,38 +187,72 @@ func ModelClassifyTensor(tensor *tf.Tensor) ([]float32, error) {
 	return results[0].Value().([][]float32)[0], err
 }
 
-// Classify an Image returning true if it's considered safe
-func ModelClassifyImage(someImage image.Image) (bool, error) {
-
-	// Resize Image to Usable Size
+// Prepare an Image the way the Model was trained: flattened onto an opaque
+// MODEL_SIZE background, resized with bilinear filtering and laid out row by
+// row as [height][width][rgb] floats between 0 and 1
+func ModelPreprocess(someImage image.Image, background *image.RGBA) []float32 {
 	resized := image.NewRGBA(image.Rect(0, 0, MODEL_SIZE, MODEL_SIZE))
-	draw.NearestNeighbor.Scale(resized, resized.Rect, someImage, someImage.Bounds(), draw.Over, nil)
-
-	// Convert Pixel Data into Normalized Floats
-	var tensorCap = MODEL_SIZE * MODEL_SIZE * 3
-	var tensorData = make([]float32, 0, tensorCap)
-	var tensorShape = []int64{1, MODEL_SIZE, MODEL_SIZE, 3}
-	for x := 0; x < MODEL_SIZE; x++ {
-		for y := 0; y < MODEL_SIZE; y++ {
-			r, g, b, _ := resized.At(x, y).RGBA()
-			tensorData = append(tensorData, float32(r)/65535, float32(g)/65535, float32(b)/65535)
+	copy(resized.Pix, background.Pix)
+	draw.BiLinear.Scale(resized, resized.Rect, someImage, someImage.Bounds(), draw.Over, nil)
+
+	// Background is opaque so the premultiplied pixels are already flattened
+	tensorData := make([]float32, MODEL_SIZE*MODEL_SIZE*3)
+	for y := 0; y < MODEL_SIZE; y++ {
+		row := resized.Pix[y*resized.Stride : y*resized.Stride+MODEL_SIZE*4]
+		out := tensorData[y*MODEL_SIZE*3 : (y+1)*MODEL_SIZE*3]
+		for x := 0; x < MODEL_SIZE; x++ {
+			out[x*3+0] = float32(row[x*4+0]) / 255
+			out[x*3+1] = float32(row[x*4+1]) / 255
+			out[x*3+2] = float32(row[x*4+2]) / 255
 		}
 	}
+	return tensorData
+}
+
+// Classify an Image returning the score for each category, images with
+// transparency are classified on every configured background and the most
+// inappropriate result is returned as transparent areas could hide content
+func ModelClassifyImage(someImage image.Image) (ModelScores, error) {
+	backgrounds := Config().Moderation.Backgrounds
+	if o, ok := someImage.(interface{ Opaque() bool }); ok && o.Opaque() {
+		backgrounds = backgrounds[:1]
+	}
+	var worst ModelScores
+	for i, name := range backgrounds {
+		scores, err := modelClassifyData(ModelPreprocess(someImage, modelBackground(name)))
+		if err != nil {
+			return ModelScores{}, err
+		}
+		if i == 0 || scores.Score() > worst.Score() {
+			worst = scores
+		}
+	}
+	return worst, nil
+}
+
+// Classify Preprocessed Image Data
+func modelClassifyData(tensorData []float32) (ModelScores, error) {
+	tensorShape := []int64{1, MODEL_SIZE, MODEL_SIZE, 3}
 
 	// Create Tensor, reshape it, then classify
 	tensor, err := tf.NewTensor(tensorData)
 	if err != nil {
-		return false, err
+		return ModelScores{}, err
 	}
 	if err := tensor.Reshape(tensorShape); err != nil {
-		return false, err
+		return ModelScores{}, err
 	}
 	results, err := ModelClassifyTensor(tensor)
 	if err != nil {
-		return false, err
+		return ModelScores{}, err
 	}
 
-	// Calculate How Inappropriate this Image is
 	// Drawing[0], Hentai[1], Neutral[2], Porn[3], Sexy[4]
-	return (results[1] + results[3] + (results[4] * 0.9)) < MODEL_TRESHOLD, nil
+	return ModelScores{
+		Drawing: results[0],
+		Hentai:  results[1],
+		Neutral: results[2],
+		Porn:    results[3],
+		Sexy:    results[4],
+	}, nil
 }
@@ -0,0 +1,198 @@
+package env
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateReference = flag.Bool("update-reference", false, "record model reference scores")
+
+const MODEL_REFERENCE_PATH = "testdata/model_reference.json"
+
+// Returns the value written for channel c of pixel (x, y) in [height][width][rgb] order
+func testTensorAt(data []float32, x, y, c int) float32 {
+	return data[(y*MODEL_SIZE+x)*3+c]
+}
+
+func testNear(t *testing.T, name string, got, want float32) {
+	t.Helper()
+	if math.Abs(float64(got-want)) > 1.0/255 {
+		t.Errorf("%s: got %.4f, want %.4f", name, got, want)
+	}
+}
+
+func TestModelPreprocessLayout(t *testing.T) {
+	// Corners of the source land in the corners of the tensor, so swapping
+	// rows for columns or interleaving channels by plane would move them
+	src := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	src.Set(0, 0, color.RGBA{255, 0, 0, 255})
+	src.Set(1, 0, color.RGBA{0, 255, 0, 255})
+	src.Set(0, 1, color.RGBA{0, 0, 255, 255})
+	src.Set(1, 1, color.RGBA{255, 255, 255, 255})
+	data := ModelPreprocess(src, modelBackgrounds[BACKGROUND_BLACK])
+	if len(data) != MODEL_SIZE*MODEL_SIZE*3 {
+		t.Fatalf("got %d values, want %d", len(data), MODEL_SIZE*MODEL_SIZE*3)
+	}
+	last := MODEL_SIZE - 1
+	for _, c := range []struct {
+		name    string
+		x, y    int
+		r, g, b float32
+	}{
+		{"top left", 0, 0, 1, 0, 0},
+		{"top right", last, 0, 0, 1, 0},
+		{"bottom left", 0, last, 0, 0, 1},
+		{"bottom right", last, last, 1, 1, 1},
+	} {
+		testNear(t, c.name+" red", testTensorAt(data, c.x, c.y, 0), c.r)
+		testNear(t, c.name+" green", testTensorAt(data, c.x, c.y, 1), c.g)
+		testNear(t, c.name+" blue", testTensorAt(data, c.x, c.y, 2), c.b)
+	}
+}
+
+func TestModelPreprocessBilinear(t *testing.T) {
+	// Black on the left and white on the right blend smoothly across the middle
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, color.Black)
+	src.Set(1, 0, color.White)
+	data := ModelPreprocess(src, modelBackgrounds[BACKGROUND_BLACK])
+
+	y := MODEL_SIZE / 2
+	previous := float32(-1)
+	for x := 0; x < MODEL_SIZE; x++ {
+		v := testTensorAt(data, x, y, 0)
+		if v < previous {
+			t.Fatalf("column %d: %.4f darker than column before (%.4f)", x, v, previous)
+		}
+		previous = v
+	}
+	mid := (testTensorAt(data, MODEL_SIZE/2-1, y, 0) + testTensorAt(data, MODEL_SIZE/2, y, 0)) / 2
+	testNear(t, "middle", mid, 0.5)
+
+	// Rows are identical as the source has only one
+	for x := 0; x < MODEL_SIZE; x++ {
+		testNear(t, "first row", testTensorAt(data, x, 0, 0), testTensorAt(data, x, y, 0))
+	}
+}
+
+func TestModelPreprocessAlpha(t *testing.T) {
+	// Transparent pixels show the background, partially transparent ones are blended with it
+	clear := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	data := ModelPreprocess(clear, modelBackgrounds[BACKGROUND_WHITE])
+	for i, v := range data {
+		if v != 1 {
+			t.Fatalf("value %d: transparent pixel on white gave %.4f", i, v)
+		}
+	}
+
+	half := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			half.SetRGBA(x, y, color.RGBA{128, 0, 0, 128}) // premultiplied red at 50%
+		}
+	}
+	center := MODEL_SIZE / 2
+	data = ModelPreprocess(half, modelBackgrounds[BACKGROUND_BLACK])
+	testNear(t, "red over black", testTensorAt(data, center, center, 0), 128.0/255)
+	testNear(t, "green over black", testTensorAt(data, center, center, 1), 0)
+	data = ModelPreprocess(half, modelBackgrounds[BACKGROUND_WHITE])
+	testNear(t, "red over white", testTensorAt(data, center, center, 0), 1)
+	testNear(t, "green over white", testTensorAt(data, center, center, 1), 127.0/255)
+}
+
+// Synthetic Images classified against the recorded reference scores
+func testReferenceImages() map[string]image.Image {
+	grey := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	stripes := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	cutout := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			grey.Set(x, y, color.RGBA{128, 128, 128, 255})
+			stripes.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), 96, 255})
+			if (x-32)*(x-32)+(y-32)*(y-32) < 400 {
+				cutout.Set(x, y, color.RGBA{200, 40, 40, 255})
+			}
+		}
+	}
+	return map[string]image.Image{"grey": grey, "stripes": stripes, "cutout": cutout}
+}
+
+func TestModelReferenceScores(t *testing.T) {
+	dir := MODEL_DIRECTORY
+	if _, err := os.Stat(filepath.Join(dir, "saved_model.pb")); err != nil {
+		dir = filepath.Join("..", MODEL_DIRECTORY) // tests run from the package directory
+	}
+	if _, err := os.Stat(filepath.Join(dir, "saved_model.pb")); err != nil {
+		t.Skip("model not found in MODEL_DIRECTORY")
+	}
+	previous := MODEL_DIRECTORY
+	MODEL_DIRECTORY = dir
+	defer func() { MODEL_DIRECTORY = previous }()
+	if err := ModelLoad(); err != nil {
+		t.Fatalf("cannot load model: %v", err)
+	}
+
+	got := make(map[string]ModelScores)
+	for name, img := range testReferenceImages() {
+		scores, err := ModelClassifyImage(img)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		scores.Text = 0
+		got[name] = scores
+	}
+	if *updateReference {
+		b, _ := json.MarshalIndent(got, "", "    ")
+		if err := os.MkdirAll(filepath.Dir(MODEL_REFERENCE_PATH), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(MODEL_REFERENCE_PATH, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	// The model is present, so the reference must be too or nothing is checked
+	b, err := os.ReadFile(MODEL_REFERENCE_PATH)
+	if errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("no reference scores recorded in %s, run with -update-reference against the shipped model", MODEL_REFERENCE_PATH)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want map[string]ModelScores
+	if err := json.Unmarshal(b, &want); err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != len(got) {
+		t.Errorf("reference has %d images, test classified %d, run with -update-reference", len(want), len(got))
+	}
+	for name, w := range want {
+		g, ok := got[name]
+		if !ok {
+			t.Errorf("%s: recorded in the reference but no longer classified", name)
+			continue
+		}
+		for _, c := range []struct {
+			category string
+			got, w   float32
+		}{
+			{"drawing", g.Drawing, w.Drawing},
+			{"hentai", g.Hentai, w.Hentai},
+			{"neutral", g.Neutral, w.Neutral},
+			{"porn", g.Porn, w.Porn},
+			{"sexy", g.Sexy, w.Sexy},
+		} {
+			if math.Abs(float64(c.got-c.w)) > 1e-3 {
+				t.Errorf("%s %s: got %.4f, want %.4f", name, c.category, c.got, c.w)
+			}
+		}
+	}
+}
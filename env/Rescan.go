@@ -0,0 +1,296 @@
+package env
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	RESCAN_BATCH          = 64          // Stickers Scanned between Checkpoints
+	RESCAN_CHECK_INTERVAL = time.Minute // Time between checking if the model or policy has changed
+	RESCAN_HIDE           = "hide"      // Hide Stickers which now fail moderation
+	RESCAN_FLAG           = "flag"      // Flag Stickers which now fail moderation for review
+)
+
+// Progress of Re-Moderating every Sticker, saved after each batch so an
+// interrupted scan resumes where it left off
+type RescanStatus struct {
+	Running  bool      `json:"running"`  // Scan in Progress?
+	Model    string    `json:"model"`    // Model Version being Scanned with
+	Policy   string    `json:"policy"`   // Policy Version being Scanned with
+	Started  time.Time `json:"started"`  // Scan Started
+	Finished time.Time `json:"finished"` // Scan Finished (zero if incomplete)
+	Cursor   int       `json:"cursor"`   // Highest Sticker ID Scanned so far
+	Total    int       `json:"total"`    // Stickers to Scan
+	Scanned  int       `json:"scanned"`  // Stickers Scanned so far
+	Failed   []int     `json:"failed"`   // Stickers which could not be Scanned
+	Hidden   []int     `json:"hidden"`   // Stickers Hidden by the Scan
+	Flagged  []int     `json:"flagged"`  // Stickers Flagged by the Scan
+}
+
+var (
+	rescanMtx     sync.Mutex
+	rescanStatus  RescanStatus
+	rescanTrigger chan struct{} // nil until the service is started
+	RescanPath    = path.Join(DATA_DIRECTORY, "rescan.json")
+)
+
+var ErrRescanRunning = errors.New("a rescan is already running")
+
+// Re-Moderate every Sticker whenever the model or policy changes, resuming any
+// scan interrupted by a restart
+func SetupRescan(stop context.Context, await *sync.WaitGroup) {
+	if err := RescanLoad(); err != nil {
+		slog.Warn("[rescan] Cannot Load Progress, Starting Over", "error", err)
+	}
+	rescanMtx.Lock()
+	rescanTrigger = make(chan struct{}, 1)
+	rescanMtx.Unlock()
+
+	await.Add(1)
+	go func() {
+		defer await.Done()
+		t := time.NewTicker(RESCAN_CHECK_INTERVAL)
+		defer t.Stop()
+		restart := false
+		for {
+			if restart || rescanNeeded() {
+				status, err := RescanRun(stop, restart)
+				switch {
+				case errors.Is(err, context.Canceled):
+					slog.Info("[rescan] Scan Paused", "scanned", status.Scanned, "total", status.Total)
+				case err != nil:
+					slog.Error("[rescan] Scan Error", "error", err)
+				}
+			}
+			select {
+			case <-stop.Done():
+				return
+			case <-t.C:
+				restart = false
+			case <-rescanTrigger:
+				restart = true
+			}
+		}
+	}()
+}
+
+// Returns true if scans are run in the background by this process
+func RescanServing() bool {
+	rescanMtx.Lock()
+	defer rescanMtx.Unlock()
+	return rescanTrigger != nil
+}
+
+// Start a new Scan in the background, unless one is already running
+func RescanStart() {
+	rescanMtx.Lock()
+	defer rescanMtx.Unlock()
+	if rescanTrigger != nil && !rescanStatus.Running {
+		select {
+		case rescanTrigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Returns the Progress of the Current or Previous Scan
+func RescanProgress() RescanStatus {
+	rescanMtx.Lock()
+	defer rescanMtx.Unlock()
+	s := rescanStatus
+	s.Failed = slices.Clone(s.Failed)
+	s.Hidden = slices.Clone(s.Hidden)
+	s.Flagged = slices.Clone(s.Flagged)
+	return s
+}
+
+// Read Progress of the Previous Scan from Disk (if any)
+func RescanLoad() error {
+	b, err := os.ReadFile(RescanPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var loaded RescanStatus
+	if err := json.Unmarshal(b, &loaded); err != nil {
+		return err
+	}
+	loaded.Running = false
+	rescanMtx.Lock()
+	rescanStatus = loaded
+	rescanMtx.Unlock()
+	return nil
+}
+
+// Write Progress to Disk, must be called with rescanMtx held
+func rescanSave() error {
+	b, err := json.MarshalIndent(&rescanStatus, "", "    ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(RescanPath, b)
+}
+
+// Returns true if the previous scan is incomplete or used another model or policy
+func rescanNeeded() bool {
+	rescanMtx.Lock()
+	defer rescanMtx.Unlock()
+	return rescanStatus.Finished.IsZero() ||
+		rescanStatus.Model != ModelVersion ||
+		rescanStatus.Policy != VerdictPolicy()
+}
+
+// Re-Moderate every Sticker, continuing the previous scan if it was
+// interrupted unless restart is set. Cancelling the context pauses the scan.
+func RescanRun(ctx context.Context, restart bool) (RescanStatus, error) {
+	rescanMtx.Lock()
+	if rescanStatus.Running {
+		rescanMtx.Unlock()
+		return RescanProgress(), ErrRescanRunning
+	}
+	model, policy := ModelVersion, VerdictPolicy()
+	s := &rescanStatus
+	if restart || s.Model != model || s.Policy != policy || !s.Finished.IsZero() {
+		*s = RescanStatus{
+			Model:   model,
+			Policy:  policy,
+			Started: time.Now(),
+			Failed:  []int{},
+			Hidden:  []int{},
+			Flagged: []int{},
+		}
+		slog.Info("[rescan] Scan Started", "model", model, "policy", policy)
+	} else {
+		slog.Info("[rescan] Scan Resumed", "model", model, "policy", policy, "cursor", s.Cursor)
+	}
+	s.Running = true
+	cursor := s.Cursor
+
+	// Stickers are scanned in ID order so the cursor marks our progress
+	DatabaseMtx.RLock()
+	remaining := make([]DatabaseSticker, 0, len(Database.Stickers))
+	for _, sticker := range Database.Stickers {
+		if sticker.ID > cursor {
+			remaining = append(remaining, sticker)
+		}
+	}
+	DatabaseMtx.RUnlock()
+	slices.SortFunc(remaining, func(a, b DatabaseSticker) int { return a.ID - b.ID })
+	s.Total = s.Scanned + len(remaining)
+	rescanMtx.Unlock()
+
+	defer func() {
+		rescanMtx.Lock()
+		rescanStatus.Running = false
+		if err := rescanSave(); err != nil {
+			slog.Error("[rescan] Cannot Save Progress", "error", err)
+		}
+		rescanMtx.Unlock()
+	}()
+
+	for start := 0; start < len(remaining); start += RESCAN_BATCH {
+		batch := remaining[start:min(start+RESCAN_BATCH, len(remaining))]
+		verdicts := make([]Verdict, len(batch))
+		failures := make([]error, len(batch))
+		Multithread(ctx, WORKER_LIMIT, len(batch), func(ctx context.Context, i int) error {
+			verdicts[i], failures[i] = rescanSticker(batch[i])
+			return nil
+		})
+		if err := ctx.Err(); err != nil {
+			return RescanProgress(), err
+		}
+		hidden, flagged := rescanApply(batch, verdicts, failures)
+
+		rescanMtx.Lock()
+		for i := range batch {
+			if failures[i] != nil {
+				slog.Warn("[rescan] Cannot Scan Sticker", "id", batch[i].ID, "error", failures[i])
+				s.Failed = append(s.Failed, batch[i].ID)
+			}
+		}
+		s.Hidden = append(s.Hidden, hidden...)
+		s.Flagged = append(s.Flagged, flagged...)
+		s.Cursor = batch[len(batch)-1].ID
+		s.Scanned += len(batch)
+		if err := rescanSave(); err != nil {
+			slog.Error("[rescan] Cannot Save Progress", "error", err)
+		}
+		rescanMtx.Unlock()
+		if len(hidden) > 0 {
+			StickerboardQueue()
+		}
+	}
+
+	rescanMtx.Lock()
+	s.Finished = time.Now()
+	rescanMtx.Unlock()
+	status := RescanProgress()
+	slog.Info("[rescan] Scan Finished",
+		"scanned", status.Scanned,
+		"failed", len(status.Failed),
+		"hidden", len(status.Hidden),
+		"flagged", len(status.Flagged),
+		"took", status.Finished.Sub(status.Started),
+	)
+	return status, nil
+}
+
+// Classify a Sticker's Image, verdicts for images already scanned are reused
+func rescanSticker(sticker DatabaseSticker) (Verdict, error) {
+	if v, ok := VerdictLookup(sticker.ImageHash); ok {
+		return v, nil
+	}
+	data, err := os.ReadFile(path.Join(DATA_DIRECTORY, sticker.ImageHash))
+	if err != nil {
+		return Verdict{}, err
+	}
+	frames, err := ImageDecodeFrames(data, sticker.ImageType)
+	if err != nil {
+		return Verdict{}, err
+	}
+	return VerdictClassify(sticker.ImageHash, frames)
+}
+
+// Hide or Flag Visible Stickers which failed moderation, returning their IDs
+func rescanApply(batch []DatabaseSticker, verdicts []Verdict, failures []error) (hidden, flagged []int) {
+	action := Config().Moderation.RescanAction
+	DatabaseMtx.Lock()
+	defer DatabaseMtx.Unlock()
+	for i := range batch {
+		if failures[i] != nil || verdicts[i].Safe {
+			continue
+		}
+		j, err := DatabaseFind(batch[i].ID)
+		if err != nil || !Database.Stickers[j].Visible {
+			continue
+		}
+		frame := max(verdicts[i].UnsafeFrame(), 0)
+		s := &Database.Stickers[j]
+		s.Flagged = fmt.Sprintf("rescan: scored %.2f", verdicts[i].Scores[frame].Score())
+		scores := verdicts[i].Scores[frame]
+		scores.Text = verdicts[i].TextScore()
+		s.FlagScores = &scores
+		if action == RESCAN_HIDE {
+			s.Visible = false
+			hidden = append(hidden, s.ID)
+		} else {
+			flagged = append(flagged, s.ID)
+		}
+		slog.Warn("[rescan] Sticker Failed Moderation", "id", s.ID, "action", action, "scores", verdicts[i].Scores[frame])
+	}
+	if len(hidden)+len(flagged) > 0 {
+		DatabaseVersion.Add(1)
+	}
+	return hidden, flagged
+}
@@ -0,0 +1,64 @@
+package env
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sync/atomic"
+
+	"bakonpancakz/stickerboard/resources"
+)
+
+var (
+	// Website Resources, files in the theme directory take priority over those embedded
+	Resources fs.FS = resourcesFS{}
+	// Incremented whenever the theme directory changes so parsed templates can be cached
+	ResourcesVersion atomic.Uint64
+	resourcesCurrent atomic.Pointer[overlayFS]
+)
+
+type overlayFS struct {
+	theme string // Theme Directory (optional)
+	upper fs.FS  // Theme Files (optional)
+	lower fs.FS  // Embedded Files
+}
+
+// Forwards to the Current Overlay so the theme can be swapped while serving
+type resourcesFS struct{}
+
+func (resourcesFS) Open(name string) (fs.File, error) {
+	if o := resourcesCurrent.Load(); o != nil {
+		return o.Open(name)
+	}
+	return resources.Embedded.Open(name)
+}
+
+// Serve Resources from the given theme directory, falling back to those embedded
+func ResourcesLoad(themeDirectory string) {
+	o := overlayFS{theme: themeDirectory, lower: resources.Embedded}
+	if themeDirectory != "" {
+		o.upper = os.DirFS(themeDirectory)
+	}
+	resourcesCurrent.Store(&o)
+	ResourcesVersion.Add(1)
+}
+
+func resourcesTheme() string {
+	if o := resourcesCurrent.Load(); o != nil {
+		return o.theme
+	}
+	return ""
+}
+
+func (o *overlayFS) Open(name string) (fs.File, error) {
+	if o.upper != nil {
+		f, err := o.upper.Open(name)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return o.lower.Open(name)
+}
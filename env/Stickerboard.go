@@ -2,19 +2,21 @@ package env
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
-	"log"
+	"log/slog"
+	"math"
 	"os"
 	"os/exec"
 	"path"
-	"runtime"
+	"slices"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"golang.org/x/image/draw"
@@ -31,14 +33,134 @@ const (
 )
 
 var (
-	StickerboardReady atomic.Bool
-	StickerboardPath  = path.Join(DATA_DIRECTORY, STICKERBOARD_FILENAME)
-	StickerboardBack  *image.RGBA
-	StickerboardMtx   sync.RWMutex
-	Stickerboard      []byte
+	StickerboardReady          = NewSignal()
+	StickerboardPath           = path.Join(DATA_DIRECTORY, STICKERBOARD_FILENAME)
+	StickerboardBackgroundPath = path.Join(DATA_DIRECTORY, BACKGROUND_FILENAME)
+	StickerboardBack           *image.RGBA
+	StickerboardStill          *image.RGBA // First Frame of the Served Stickerboard (nil until rendered)
+	StickerboardMtx            sync.RWMutex
+	Stickerboard               []byte
+)
+
+var (
+	ErrStickerScale     = errors.New("Invalid Image Scale")
+	ErrStickerTooLarge  = errors.New("Image is Too Large")
+	ErrStickerOffscreen = errors.New("Image cannot be placed off-screen")
+)
+
+// Validate the Placement of a width by height Image scaled by a percentage,
+// shared by uploads, edits and imports
+func StickerboardValidatePlacement(width, height, scale, offsetX, offsetY int) error {
+	if scale < 1 || scale > 100 {
+		return ErrStickerScale
+	}
+	scaledFloat := float32(scale) / 100
+	scaledWidth := int((float32(width) * scaledFloat))
+	scaledHeight := int((float32(height) * scaledFloat))
+	if scaledHeight > (CANVAS_STICKER_MAX_HEIGHT + 4) {
+		return ErrStickerTooLarge
+	}
+	if offsetX < -scaledWidth || offsetX > CANVAS_WIDTH ||
+		offsetY < -scaledHeight || offsetY > CANVAS_HEIGHT {
+		return ErrStickerOffscreen
+	}
+	return nil
+}
+
+// Validate the Placement of a stored Sticker
+func StickerboardValidateSticker(s DatabaseSticker) error {
+	scale := int(math.Round(s.ImageScale * 100))
+	return StickerboardValidatePlacement(s.ImageWidth, s.ImageHeight, scale, s.OffsetX, s.OffsetY)
+}
+
+// Renders are queued for a single background goroutine, requests made while a
+// render is in progress are coalesced into the one following it
+type stickerboardResult struct {
+	Count int
+	Err   error
+}
+
+var (
+	stickerboardQueueMtx sync.Mutex
+	stickerboardQueue    chan struct{}             // Wakes the Renderer (nil until started)
+	stickerboardWaiters  []chan stickerboardResult // Awaiting the next Render
+	stickerboardRunning  sync.WaitGroup            // Held while the Renderer is running
+	stickerboardStopped  bool                      // Renderer has shutdown
 )
 
 func init() {
+	StickerboardLoadBackground()
+
+	// Serve Previous Render (if any) until the next one completes
+	if _, err := os.Stat(StickerboardPath); err == nil {
+		stickerboardCopy()
+	}
+}
+
+// Start the Renderer and queue the initial render, any render still in
+// progress during shutdown is cancelled and it's encoder stopped
+func SetupStickerboard(stop context.Context, await *sync.WaitGroup) {
+	stickerboardQueueMtx.Lock()
+	stickerboardQueue = make(chan struct{}, 1)
+	stickerboardQueueMtx.Unlock()
+
+	await.Add(1)
+	stickerboardRunning.Add(1)
+	go func() {
+		defer await.Done()
+		defer stickerboardRunning.Done()
+		for {
+			select {
+			case <-stop.Done():
+				stickerboardQueueMtx.Lock()
+				waiters := stickerboardWaiters
+				stickerboardWaiters, stickerboardStopped = nil, true
+				stickerboardQueueMtx.Unlock()
+				for _, w := range waiters {
+					w <- stickerboardResult{Err: stop.Err()}
+				}
+				slog.Info("[stickerboard] Cleaned up Renderer")
+				return
+			case <-stickerboardQueue:
+			}
+
+			// Render for everyone waiting so far
+			stickerboardQueueMtx.Lock()
+			waiters := stickerboardWaiters
+			stickerboardWaiters = nil
+			stickerboardQueueMtx.Unlock()
+			n, err := stickerboardRenderNow(stop)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				slog.Error("[stickerboard] Render Error", "error", err)
+			}
+			for _, w := range waiters {
+				w <- stickerboardResult{Count: n, Err: err}
+			}
+		}
+	}()
+	StickerboardQueue()
+}
+
+// Request a Render without waiting for it
+func StickerboardQueue() {
+	stickerboardQueueMtx.Lock()
+	defer stickerboardQueueMtx.Unlock()
+	if stickerboardQueue != nil && !stickerboardStopped {
+		select {
+		case stickerboardQueue <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Wait for the Renderer to finish, any render in progress has been cancelled
+// by this point so it will not write to the Database afterwards
+func StickerboardAwait() {
+	stickerboardRunning.Wait()
+}
+
+// Load the Custom Background (if any) used by future renders
+func StickerboardLoadBackground() {
 	// Initialize Background to Black to Prevent Coalescing
 	base := image.NewRGBA(image.Rect(0, 0, CANVAS_WIDTH, CANVAS_HEIGHT))
 	for x := 0; x < CANVAS_WIDTH; x++ {
@@ -46,154 +168,114 @@ func init() {
 			base.Set(x, y, color.Black)
 		}
 	}
-	StickerboardBack = base
 
 	// Load Custom Background (if any)
-	p := path.Join(DATA_DIRECTORY, "background.png")
-	if f, err := os.Open(p); err == nil {
+	if f, err := os.Open(StickerboardBackgroundPath); err == nil {
 		if o, err := png.Decode(f); err == nil {
 			b := base.Bounds()
 			draw.CatmullRom.Scale(base, b.Bounds(), o, o.Bounds(), draw.Over, nil)
 		}
 		f.Close()
 	}
+
+	StickerboardMtx.Lock()
+	StickerboardBack = base
+	StickerboardMtx.Unlock()
 }
 
 func stickerboardCopy() {
 	b, err := os.ReadFile(StickerboardPath)
 	if err != nil {
-		log.Println("[stickerboard] Read Image Error:", err)
+		slog.Error("[stickerboard] Read Image Error", "error", err)
 		return
 	}
 	StickerboardMtx.Lock()
 	Stickerboard = b
-	StickerboardReady.Store(true)
 	StickerboardMtx.Unlock()
+	StickerboardReady.Set()
 }
 
-func StickerboardRender() (int, error) {
-	t := time.Now()
-
-	// Mass Decode and Resizing of all Stickers
-	type DecodedSticker struct {
-		Position image.Rectangle
-		Frames   []*image.RGBA
-		Delays   []int
+// Queue a Render and wait for it to complete, the context only limits how long
+// we wait as others may be waiting on the same render. If the Renderer is not
+// running (e.g. admin commands) the Stickerboard is rendered immediately instead.
+func StickerboardRender(ctx context.Context) (int, error) {
+	stickerboardQueueMtx.Lock()
+	if stickerboardStopped {
+		stickerboardQueueMtx.Unlock()
+		return 0, context.Canceled
 	}
-	stickers := make([]DecodedSticker, len(Database.Stickers))
-
-	DatabaseMtx.RLock()
-	if err := Multithread(len(stickers), func(i int) error {
-
-		// Read Sticker from Disk
-		info := &Database.Stickers[i]
-		path := path.Join(DATA_DIRECTORY, info.ImageHash)
-		reader, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer reader.Close()
-		var images = make([]image.Image, 1)
-		var delays = make([]int, 1)
-
-		// Decode Sticker Frames
-		var decodeGIF *gif.GIF
-		var decodeImage image.Image
-		var decodeError error
-		switch info.ImageType {
-		case IMAGE_GIF:
-			decodeGIF, decodeError = gif.DecodeAll(reader)
-		case IMAGE_WEBP:
-			decodeImage, decodeError = webp.Decode(reader)
-		case IMAGE_JPEG:
-			decodeImage, decodeError = jpeg.Decode(reader)
-		case IMAGE_PNG:
-			decodeImage, decodeError = png.Decode(reader)
-		default:
-			return fmt.Errorf("decoder available")
-		}
-		if decodeError != nil {
-			return err
-		}
-		if info.ImageType == IMAGE_GIF {
-
-			// This section here properly layers GIF frames
-
-			delays = decodeGIF.Delay
-			images = make([]image.Image, len(decodeGIF.Image))
-
-			var imageBase = image.NewRGBA(image.Rect(0, 0, decodeGIF.Config.Width, decodeGIF.Config.Height))
-			var imagePrev *image.RGBA
-			var disposal = byte(gif.DisposalNone)
+	if stickerboardQueue == nil {
+		stickerboardQueueMtx.Unlock()
+		return stickerboardRenderNow(ctx)
+	}
+	done := make(chan stickerboardResult, 1)
+	stickerboardWaiters = append(stickerboardWaiters, done)
+	select {
+	case stickerboardQueue <- struct{}{}:
+	default:
+	}
+	stickerboardQueueMtx.Unlock()
 
-			for i, frame := range decodeGIF.Image {
-				if disposal == gif.DisposalPrevious {
-					imagePrev = image.NewRGBA(imageBase.Bounds())
-					copy(imageBase.Pix, imagePrev.Pix)
-				}
-				if i > 0 {
-					switch disposal {
-					case gif.DisposalBackground:
-						draw.Draw(imageBase, decodeGIF.Image[i-1].Bounds(), image.Transparent, image.Point{}, draw.Src)
-					case gif.DisposalPrevious:
-						if imagePrev != nil {
-							draw.Draw(imageBase, imageBase.Bounds(), imagePrev, image.Point{}, draw.Src)
-						}
-					}
-				}
-				// Save Composited Frame
-				draw.Draw(imageBase, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
-				imageCopy := image.NewRGBA(imageBase.Bounds())
-				copy(imageCopy.Pix, imageBase.Pix)
+	select {
+	case result := <-done:
+		return result.Count, result.Err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
 
-				images[i] = imageCopy
-				disposal = decodeGIF.Disposal[i]
-			}
+// Render the Stickerboard and serve it once complete
+func stickerboardRenderNow(ctx context.Context) (int, error) {
+	n, err := StickerboardRenderTo(ctx, StickerboardPath)
+	if err != nil {
+		return 0, err
+	}
+	stickerboardCopy()
+	return n, nil
+}
 
-		} else {
-			// Copy Static Frame
-			images[0] = decodeImage
-		}
+// Render all Visible Stickers into an animated WEBP at the given path, the
+// file is only replaced once encoding has completed successfully
+func StickerboardRenderTo(ctx context.Context, outputPath string) (int, error) {
+	t := time.Now()
 
-		// Resize Decoded Frames
-		var (
-			stickerFrames   = make([]*image.RGBA, len(images))
-			stickerPosition image.Rectangle
-			stickerBounds   = images[0].Bounds()
-			stickerWidth    = int(float64(stickerBounds.Dx()) * info.ImageScale)
-			stickerHeight   = int(float64(stickerBounds.Dy()) * info.ImageScale)
-		)
-		for j := range images {
-			// Nice and Smooth Scaling
-			source := images[j]
-			scaled := image.NewRGBA(image.Rect(0, 0, stickerWidth, stickerHeight))
-			draw.CatmullRom.Scale(scaled, scaled.Bounds(), source, source.Bounds(), draw.Over, nil)
-
-			// Invert Y position because browsers placment origin is bottom-left but server is top-left
-			y := CANVAS_HEIGHT - info.OffsetY - stickerHeight
-			stickerPosition = image.Rect(info.OffsetX, y, info.OffsetX+stickerWidth, y+stickerHeight)
-			stickerFrames[j] = scaled
+	// Copy Visible Stickers
+	DatabaseMtx.RLock()
+	records := make([]DatabaseSticker, 0, len(Database.Stickers))
+	for _, s := range Database.Stickers {
+		if s.Visible {
+			records = append(records, s)
 		}
+	}
+	DatabaseMtx.RUnlock()
 
-		// Store Resized Frame
-		stickers[i] = DecodedSticker{
-			Frames:   stickerFrames,
-			Delays:   delays,
-			Position: stickerPosition,
-		}
+	// Mass Decode and Resizing of all Stickers
+	// 	A broken sticker is left off the board rather than preventing it from
+	// 	rendering at all, it's reason is stored so admins can review it later
+	stickers := make([]stickerboardSticker, len(records))
+	failures := make([]error, len(records))
+	if err := Multithread(ctx, WORKER_LIMIT, len(stickers), func(ctx context.Context, i int) error {
+		stickers[i], failures[i] = stickerboardDecode(&records[i])
 		return nil
-
 	}); err != nil {
-		DatabaseMtx.RUnlock()
 		return 0, err
 	}
-	DatabaseMtx.RUnlock()
+	stickerboardMarkBroken(records, failures)
+	stickers = slices.DeleteFunc(stickers, func(s stickerboardSticker) bool {
+		return s.Frames == nil
+	})
 
 	// Startup Encoder
+	output, err := os.CreateTemp(path.Dir(outputPath), TEMP_PREFIX+"render-*")
+	if err != nil {
+		return 0, err
+	}
+	output.Close()
+	defer os.Remove(output.Name())
 	var outputLogs bytes.Buffer
-	cmd := exec.Command(
+	cmd := exec.CommandContext(ctx,
 		"ffmpeg", "-y",
-		"-threads", fmt.Sprint(runtime.NumCPU()),
+		"-threads", fmt.Sprint(WORKER_LIMIT),
 		"-f", "rawvideo",
 		"-pix_fmt", "rgba",
 		"-s", fmt.Sprintf("%dx%d", CANVAS_WIDTH, CANVAS_HEIGHT),
@@ -203,24 +285,35 @@ func StickerboardRender() (int, error) {
 		"-compression_level", "4",
 		"-q:v", "75",
 		"-loop", "0",
-		StickerboardPath,
+		"-f", "webp",
+		output.Name(),
 	)
 	cmdStdin, err := cmd.StdinPipe()
 	if err != nil {
 		return 0, err
 	}
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = 5 * time.Second
 	cmd.Stdout = &outputLogs
 	cmd.Stderr = &outputLogs
 	if err := cmd.Start(); err != nil {
+		MetricFFMPEGFailures.Inc("")
 		return 0, err
 	}
 
 	// Generate Frames
-	for i := 0; i < CANVAS_FRAMES; i++ {
+	StickerboardMtx.RLock()
+	background := StickerboardBack
+	StickerboardMtx.RUnlock()
+	var still *image.RGBA
+	for i := 0; i < CANVAS_FRAMES && ctx.Err() == nil; i++ {
 
 		// Generate Frame
-		canvas := image.NewRGBA(StickerboardBack.Rect)
-		copy(canvas.Pix, StickerboardBack.Pix)
+		canvas := image.NewRGBA(background.Rect)
+		if i == 0 {
+			still = canvas
+		}
+		copy(canvas.Pix, background.Pix)
 		for j := range stickers {
 			decode := &stickers[j]
 			index := 0
@@ -249,16 +342,141 @@ func StickerboardRender() (int, error) {
 
 	// Await Encoding
 	cmdStdin.Close()
-	if err := cmd.Wait(); err != nil {
+	if err := cmd.Wait(); ctx.Err() != nil {
+		slog.Warn("[stickerboard] Render Cancelled", "took", time.Since(t))
+		return 0, ctx.Err()
+	} else if err != nil {
 		exitCode := -1
 		if cmd.ProcessState != nil {
 			exitCode = cmd.ProcessState.ExitCode()
 		}
-		log.Println("[sticker] FFMPEG Exited With Code %d\n%s\n", exitCode, outputLogs.String())
+		slog.Error("[stickerboard] FFMPEG Exited With Error", "code", exitCode, "output", outputLogs.String())
+		MetricFFMPEGFailures.Inc("")
 		return 0, err
 	}
+	if err := os.Rename(output.Name(), outputPath); err != nil {
+		return 0, err
+	}
+	if outputPath == StickerboardPath {
+		StickerboardMtx.Lock()
+		StickerboardStill = still
+		StickerboardMtx.Unlock()
+	}
+	MetricRenderDuration.ObserveSince(t)
 
-	log.Printf("[sticker] Rendered %d Images in %s", len(stickers), time.Since(t))
-	stickerboardCopy()
+	slog.Info("[stickerboard] Rendered Stickerboard", "stickers", len(stickers), "broken", len(records)-len(stickers), "took", time.Since(t))
 	return len(stickers), nil
 }
+
+type stickerboardSticker struct {
+	Position image.Rectangle
+	Frames   []*image.RGBA
+	Delays   []int
+}
+
+// Read, Decode and Resize a single Sticker, recovering from any decoder panics
+func stickerboardDecode(info *DatabaseSticker) (decoded stickerboardSticker, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			decoded, err = stickerboardSticker{}, fmt.Errorf("decoder panic: %v", r)
+		}
+	}()
+
+	// Read Sticker from Disk
+	reader, err := os.Open(path.Join(DATA_DIRECTORY, info.ImageHash))
+	if err != nil {
+		return stickerboardSticker{}, err
+	}
+	defer reader.Close()
+	var images = make([]image.Image, 1)
+	var delays = make([]int, 1)
+
+	// Decode Sticker Frames
+	var decodeGIF *gif.GIF
+	var decodeImage image.Image
+	var decodeError error
+	switch info.ImageType {
+	case IMAGE_GIF:
+		decodeGIF, decodeError = gif.DecodeAll(reader)
+	case IMAGE_WEBP:
+		decodeImage, decodeError = webp.Decode(reader)
+	case IMAGE_JPEG:
+		decodeImage, decodeError = jpeg.Decode(reader)
+	case IMAGE_PNG:
+		decodeImage, decodeError = png.Decode(reader)
+	default:
+		return stickerboardSticker{}, fmt.Errorf("no decoder available for %s", info.ImageType)
+	}
+	if decodeError != nil {
+		return stickerboardSticker{}, decodeError
+	}
+	if info.ImageType == IMAGE_GIF {
+		delays = decodeGIF.Delay
+		if len(decodeGIF.Image) == 0 {
+			return stickerboardSticker{}, errors.New("animation has no frames")
+		}
+
+		// Frames without a delay would otherwise stall frame selection forever,
+		// browsers display them for 100ms so we do the same
+		for i := range delays {
+			if delays[i] <= 0 {
+				delays[i] = 10
+			}
+		}
+
+		images = ImageCompositeGIF(decodeGIF)
+	} else {
+		// Copy Static Frame
+		images[0] = decodeImage
+	}
+
+	decoded = stickerboardPlace(info, images)
+	decoded.Delays = delays
+	return decoded, nil
+}
+
+// Resize Decoded Frames and Position them on the Canvas
+func stickerboardPlace(info *DatabaseSticker, images []image.Image) stickerboardSticker {
+	var (
+		stickerFrames   = make([]*image.RGBA, len(images))
+		stickerPosition image.Rectangle
+		stickerBounds   = images[0].Bounds()
+		stickerWidth    = int(float64(stickerBounds.Dx()) * info.ImageScale)
+		stickerHeight   = int(float64(stickerBounds.Dy()) * info.ImageScale)
+	)
+	for j := range images {
+		// Nice and Smooth Scaling
+		source := images[j]
+		scaled := image.NewRGBA(image.Rect(0, 0, stickerWidth, stickerHeight))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), source, source.Bounds(), draw.Over, nil)
+
+		// Invert Y position because browsers placment origin is bottom-left but server is top-left
+		y := CANVAS_HEIGHT - info.OffsetY - stickerHeight
+		stickerPosition = image.Rect(info.OffsetX, y, info.OffsetX+stickerWidth, y+stickerHeight)
+		stickerFrames[j] = scaled
+	}
+
+	return stickerboardSticker{
+		Frames:   stickerFrames,
+		Position: stickerPosition,
+	}
+}
+
+// Log Stickers which failed to render and update their broken status
+func stickerboardMarkBroken(records []DatabaseSticker, failures []error) {
+	DatabaseMtx.Lock()
+	defer DatabaseMtx.Unlock()
+	for i, err := range failures {
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+			slog.Warn("[stickerboard] Skipping Broken Sticker", "id", records[i].ID, "hash", records[i].ImageHash, "error", err)
+		}
+		j, findErr := DatabaseFind(records[i].ID)
+		if findErr != nil || Database.Stickers[j].Broken == reason {
+			continue
+		}
+		Database.Stickers[j].Broken = reason
+		DatabaseVersion.Add(1)
+	}
+}
@@ -0,0 +1,118 @@
+package env
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const TLS_RELOAD_INTERVAL = 10 * time.Second // Minimum time between checking certificates for changes
+
+// Certificate and Key are reloaded from disk whenever they are modified so
+// renewals take effect without restarting
+type tlsKeypair struct {
+	mtx      sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time // Latest Modification of either File
+	checked  time.Time // Last Time Files were Checked
+}
+
+func tlsSetup() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	// Minimum Version
+	switch TLS_MIN_VERSION {
+	case "1.2":
+		tlsConfig.MinVersion = tls.VersionTLS12
+		tlsConfig.CipherSuites = []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		}
+	case "1.3":
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("TLS_MIN_VERSION must be 1.2 or 1.3, got %q", TLS_MIN_VERSION)
+	}
+
+	// Client Certificates
+	switch TLS_CLIENT_AUTH {
+	case "none":
+		tlsConfig.ClientAuth = tls.NoClientCert
+	case "request":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("TLS_CLIENT_AUTH must be none, request or require, got %q", TLS_CLIENT_AUTH)
+	}
+	if TLS_CA != "" {
+		caBytes, err := os.ReadFile(TLS_CA)
+		if err != nil {
+			return nil, err
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caBytes) {
+			return nil, errors.New("no certificates found in TLS_CA")
+		}
+		tlsConfig.ClientCAs = caPool
+	} else if tlsConfig.ClientAuth != tls.NoClientCert {
+		return nil, errors.New("TLS_CLIENT_AUTH requires TLS_CA to be set")
+	}
+
+	// Keypair
+	keypair := &tlsKeypair{}
+	if err := keypair.reload(); err != nil {
+		return nil, err
+	}
+	tlsConfig.GetCertificate = keypair.get
+	return tlsConfig, nil
+}
+
+func (k *tlsKeypair) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	if time.Since(k.checked) >= TLS_RELOAD_INTERVAL {
+		if err := k.reload(); err != nil {
+			slog.Error("[env/tls] Cannot Reload Keypair, Using Previous", "error", err)
+		}
+	}
+	return k.cert, nil
+}
+
+// Reload the Keypair if either file has changed, must be called with mtx held
+// (or before the keypair is in use)
+func (k *tlsKeypair) reload() error {
+	k.checked = time.Now()
+	var modified time.Time
+	for _, p := range []string{TLS_CERT, TLS_KEY} {
+		stat, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if stat.ModTime().After(modified) {
+			modified = stat.ModTime()
+		}
+	}
+	if k.cert != nil && modified.Equal(k.modified) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(TLS_CERT, TLS_KEY)
+	if err != nil {
+		return err
+	}
+	if k.cert != nil {
+		slog.Info("[env/tls] Reloaded Keypair", "cert", TLS_CERT)
+	}
+	k.cert = &cert
+	k.modified = modified
+	return nil
+}
@@ -0,0 +1,143 @@
+package env
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// A Text Field was refused, the message is safe to show to the user
+type TextError struct {
+	Field  string // Field Name shown to the User
+	Reason string // Why the Field was refused
+	Match  string // Deny Rule which Matched (if any), for logging only
+}
+
+func (e *TextError) Error() string {
+	return e.Field + " " + e.Reason
+}
+
+// Characters which reorder or hide text, commonly used to sneak words past filters
+var textInvisible = []*unicode.RangeTable{
+	unicode.Bidi_Control,
+	unicode.Join_Control,
+	{R16: []unicode.Range16{
+		{Lo: 0x200B, Hi: 0x200B, Stride: 1}, // Zero Width Space
+		{Lo: 0x2060, Hi: 0x2064, Stride: 1}, // Word Joiner and Invisible Operators
+		{Lo: 0xFEFF, Hi: 0xFEFF, Stride: 1}, // Zero Width No-Break Space
+	}},
+}
+
+// Common substitutions used to dodge word filters, symbols are only
+// substituted next to a letter so punctuation standing alone is left alone
+var (
+	textLeetDigits  = map[rune]rune{'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b', '9': 'g'}
+	textLeetSymbols = map[rune]rune{'@': 'a', '$': 's', '!': 'i', '|': 'i', '+': 't', '€': 'e'}
+)
+
+var textSeparators = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+// Normalize, Sanitize and Moderate a User Supplied Field, returning the
+// cleaned up value or a *TextError explaining why it was refused
+func TextCheck(field, value string, maxBytes int, multiline bool) (string, error) {
+	value = TextSanitize(value, multiline)
+	if len(value) > maxBytes {
+		return "", &TextError{Field: field, Reason: fmt.Sprintf("cannot be longer than %d bytes", maxBytes)}
+	}
+	if match, denied := textDenied(value); denied {
+		return "", &TextError{Field: field, Reason: "contains blocked words", Match: match}
+	}
+	return value, nil
+}
+
+// Normalize Text to NFC and remove control, bidi override and invisible
+// characters. Line breaks are kept for multiline fields.
+func TextSanitize(value string, multiline bool) string {
+	value = norm.NFC.String(strings.ToValidUTF8(value, ""))
+	value = strings.ReplaceAll(value, "\r\n", "\n")
+	value = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' && multiline:
+			return r
+		case r == '\t' || r == '\n':
+			return ' '
+		case unicode.IsControl(r), unicode.In(r, textInvisible...):
+			return -1
+		}
+		return r
+	}, value)
+	return strings.TrimSpace(value)
+}
+
+// Reduce Text to lowercase words without accents or leetspeak so deny rules
+// match regardless of how they were disguised
+func TextFold(value string) string {
+	return textFold(value, true)
+}
+
+// Symbols at the start of or within a word are always substituted, those at
+// the end only when trailing is set as they are usually punctuation
+func textFold(value string, trailing bool) string {
+	value = norm.NFKD.String(value)
+	value = strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Mn, r) {
+			return -1
+		}
+		return r
+	}, value)
+	value = cases.Fold().String(value)
+	runes := []rune(value)
+	for i, r := range runes {
+		if l, ok := textLeetDigits[r]; ok {
+			runes[i] = l
+		} else if l, ok := textLeetSymbols[r]; ok {
+			// Substituted runes count as letters, so "a$$" becomes "ass"
+			if (i+1 < len(runes) && unicode.IsLetter(runes[i+1])) ||
+				(trailing && i > 0 && unicode.IsLetter(runes[i-1])) {
+				runes[i] = l
+			}
+		}
+	}
+	value = string(runes)
+	words := strings.Fields(textSeparators.ReplaceAllString(value, " "))
+
+	// Join Letters that were spaced apart, e.g. "b a d" becomes "bad"
+	joined := make([]string, 0, len(words))
+	for i, w := range words {
+		if i > 0 && utf8.RuneCountInString(w) == 1 && utf8.RuneCountInString(words[i-1]) == 1 {
+			joined[len(joined)-1] += w
+			continue
+		}
+		joined = append(joined, w)
+	}
+	return strings.Join(joined, " ")
+}
+
+// Returns the Deny Rule matching the given text (if any)
+func textDenied(value string) (string, bool) {
+	c := Config()
+	if len(c.Moderation.denyWords) == 0 && len(c.Moderation.denyPatterns) == 0 {
+		return "", false
+	}
+	// Trailing symbols are tried both ways, "a$$" must match "ass" while
+	// "bad!" must still match "bad"
+	for _, trailing := range []bool{true, false} {
+		folded := " " + textFold(value, trailing) + " "
+		for _, word := range c.Moderation.denyWords {
+			if strings.Contains(folded, " "+word+" ") {
+				return word, true
+			}
+		}
+		for _, pattern := range c.Moderation.denyPatterns {
+			if pattern.MatchString(folded) {
+				return pattern.String(), true
+			}
+		}
+	}
+	return "", false
+}
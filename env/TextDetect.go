@@ -0,0 +1,299 @@
+package env
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path"
+	"slices"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	TEXT_SIZE           = 512  // Images are scaled to fit within this Size before analysis
+	TEXT_EDGE_THRESHOLD = 256  // Sobel Gradient (|gx|+|gy|, at most 2040) before a Pixel is an Edge
+	TEXT_EDGE_DENSITY   = 0.3  // Edge Density above which an Image is more likely Texture than Text
+	TEXT_MIN_GLYPHS     = 8    // Aligned Glyphs before an Image is considered to contain Text
+	TEXT_MAX_GLYPHS     = 4096 // Glyphs collected of each polarity, the rest of a denser image is not examined
+	TEXT_CAPTION_MARGIN = 8    // Pixels kept around the Region when saving a Caption
+)
+
+// Estimate of how much of an Image is Text, made without reading it
+type TextEstimate struct {
+	Score  float32         `json:"score"`  // Share of Edges belonging to Text, between 0 and 1
+	Glyphs int             `json:"glyphs"` // Character-like Shapes found beside others of similar size
+	Edges  float32         `json:"edges"`  // Fraction of Pixels on a Strong Edge
+	Region image.Rectangle `json:"region"` // Area containing the Glyphs, in Image Coordinates
+}
+
+// A Connected Component of the Binarized Image
+type textGlyph struct {
+	bounds image.Rectangle
+	pixels int
+	edges  int
+}
+
+// Estimate how much of an Image is Text. Troll stickers are often nothing but
+// a caption which the model happily scores as neutral, so shapes the size of
+// characters sitting in rows beside each other are counted instead.
+//
+// The image is flattened onto white, greyscaled and split into dark and light
+// pixels with Otsu's method. Each connected dark or light component with the
+// proportions of a character and strong edges is a glyph, glyphs with a
+// neighbour of similar height on the same row are taken to be text. Images
+// dense with edges are more likely texture than text and score lower.
+func ImageText(someImage image.Image) TextEstimate {
+	b := someImage.Bounds()
+	if b.Empty() {
+		return TextEstimate{}
+	}
+	scale := min(1, float64(TEXT_SIZE)/float64(max(b.Dx(), b.Dy())))
+	w, h := max(3, int(float64(b.Dx())*scale)), max(3, int(float64(b.Dy())*scale))
+
+	flat := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(flat, flat.Rect, image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.BiLinear.Scale(flat, flat.Rect, someImage, b, draw.Over, nil)
+	gray := make([]uint8, w*h)
+	for i := range gray {
+		p := flat.Pix[i*4 : i*4+3]
+		gray[i] = uint8((299*int(p[0]) + 587*int(p[1]) + 114*int(p[2])) / 1000)
+	}
+
+	// Text may be dark on light or light on dark, even within the same image
+	edges, density := textEdges(gray, w, h)
+	dark := textBinarize(gray)
+	darkGlyphs, darkEnd := textComponents(dark, true, edges, w, h)
+	lightGlyphs, lightEnd := textComponents(dark, false, edges, w, h)
+	aligned := textAligned(append(darkGlyphs, lightGlyphs...))
+
+	// Score by the share of the image's edges which belong to text, so a
+	// caption on a blank canvas scores highly whatever size it is written at
+	// while the same caption over a busy photo scores lower. Images with more
+	// glyphs than are collected are only scored on the rows examined.
+	est := TextEstimate{Glyphs: len(aligned), Edges: density}
+	covered := make([]bool, w*h)
+	for _, g := range aligned {
+		est.Region = est.Region.Union(g.bounds)
+		r := g.bounds.Inset(-1).Intersect(image.Rect(0, 0, w, h))
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				covered[y*w+x] = true
+			}
+		}
+	}
+	total, text := 0, 0
+	for i, edge := range edges[:min(darkEnd, lightEnd)] {
+		if edge {
+			total++
+			if covered[i] {
+				text++
+			}
+		}
+	}
+	if total > 0 {
+		est.Score = min(1, float32(len(aligned))/TEXT_MIN_GLYPHS) * float32(text) / float32(total)
+	}
+	if density > TEXT_EDGE_DENSITY {
+		est.Score *= TEXT_EDGE_DENSITY / density
+	}
+
+	// Map the Region back onto the Original Image
+	if !est.Region.Empty() {
+		est.Region = image.Rect(
+			b.Min.X+int(float64(est.Region.Min.X)/scale),
+			b.Min.Y+int(float64(est.Region.Min.Y)/scale),
+			b.Min.X+int(float64(est.Region.Max.X)/scale+0.5),
+			b.Min.Y+int(float64(est.Region.Max.Y)/scale+0.5),
+		).Intersect(b)
+	}
+	return est
+}
+
+// Mark Pixels on a Strong Edge, returning them alongside the fraction marked
+func textEdges(gray []uint8, w, h int) ([]bool, float32) {
+	edges := make([]bool, w*h)
+	count := 0
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			p := func(dx, dy int) int { return int(gray[(y+dy)*w+x+dx]) }
+			gx := (p(1, -1) + 2*p(1, 0) + p(1, 1)) - (p(-1, -1) + 2*p(-1, 0) + p(-1, 1))
+			gy := (p(-1, 1) + 2*p(0, 1) + p(1, 1)) - (p(-1, -1) + 2*p(0, -1) + p(1, -1))
+			if max(gx, -gx)+max(gy, -gy) > TEXT_EDGE_THRESHOLD {
+				edges[y*w+x] = true
+				count++
+			}
+		}
+	}
+	return edges, float32(count) / float32((w-2)*(h-2))
+}
+
+// Split Pixels into Dark and Light using Otsu's Method, returning true for
+// those which are dark
+func textBinarize(gray []uint8) []bool {
+	var histogram [256]int
+	for _, v := range gray {
+		histogram[v]++
+	}
+	total, sum := len(gray), 0
+	for v, n := range histogram {
+		sum += v * n
+	}
+	var (
+		best      float64
+		threshold int
+		below     int
+		belowSum  int
+	)
+	for v, n := range histogram {
+		below += n
+		belowSum += v * n
+		above := total - below
+		if below == 0 || above == 0 {
+			continue
+		}
+		mb := float64(belowSum) / float64(below)
+		ma := float64(sum-belowSum) / float64(above)
+		if between := float64(below) * float64(above) * (mb - ma) * (mb - ma); between > best {
+			best, threshold = between, v
+		}
+	}
+	dark := make([]bool, len(gray))
+	for i, v := range gray {
+		dark[i] = int(v) <= threshold
+	}
+	return dark
+}
+
+// Collect Connected Components of Pixels where mask is set to want which are
+// shaped like Characters, those touching the border are part of the
+// background or a larger shape. Also returns the start of the first row not
+// fully examined, which is the end of the mask unless TEXT_MAX_GLYPHS is hit.
+func textComponents(mask []bool, want bool, edges []bool, w, h int) ([]textGlyph, int) {
+	seen := make([]bool, w*h)
+	stack := make([]int, 0, 64)
+	glyphs := make([]textGlyph, 0)
+	for start := range mask {
+		if mask[start] != want || seen[start] {
+			continue
+		}
+		g := textGlyph{bounds: image.Rect(start%w, start/w, start%w+1, start/w+1)}
+		seen[start] = true
+		stack = append(stack[:0], start)
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			x, y := i%w, i/w
+			g.bounds = g.bounds.Union(image.Rect(x, y, x+1, y+1))
+			g.pixels++
+			if edges[i] {
+				g.edges++
+			}
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					nx, ny := x+dx, y+dy
+					if nx < 0 || ny < 0 || nx >= w || ny >= h {
+						continue
+					}
+					if j := ny*w + nx; mask[j] == want && !seen[j] {
+						seen[j] = true
+						stack = append(stack, j)
+					}
+				}
+			}
+		}
+		if textGlyphLike(g, w, h) {
+			glyphs = append(glyphs, g)
+			if len(glyphs) == TEXT_MAX_GLYPHS {
+				return glyphs, start - start%w
+			}
+		}
+	}
+	return glyphs, len(mask)
+}
+
+func textGlyphLike(g textGlyph, w, h int) bool {
+	gw, gh := g.bounds.Dx(), g.bounds.Dy()
+	fill := float32(g.pixels) / float32(gw*gh)
+	return g.bounds.Min.X > 0 && g.bounds.Min.Y > 0 && g.bounds.Max.X < w && g.bounds.Max.Y < h &&
+		gh >= 5 && gh <= h/2 && gw <= gh*3 &&
+		fill >= 0.1 && (fill <= 0.9 || gw*3 <= gh) &&
+		float32(g.edges) >= float32(g.pixels)*0.25
+}
+
+// Returns Glyphs with a Neighbour of similar height on the same row
+func textAligned(glyphs []textGlyph) []textGlyph {
+	slices.SortFunc(glyphs, func(a, b textGlyph) int { return a.bounds.Min.X - b.bounds.Min.X })
+	aligned := make([]bool, len(glyphs))
+	for i, a := range glyphs {
+		ah := a.bounds.Dy()
+		for j := i + 1; j < len(glyphs); j++ {
+			b := glyphs[j]
+			bh := b.bounds.Dy()
+			tall := max(ah, bh)
+			if b.bounds.Min.X-a.bounds.Max.X > ah*3/2 {
+				break
+			}
+			overlap := min(a.bounds.Max.Y, b.bounds.Max.Y) - max(a.bounds.Min.Y, b.bounds.Min.Y)
+			if tall*2 > min(ah, bh)*3 || overlap*2 < min(ah, bh) ||
+				b.bounds.Min.X-a.bounds.Max.X > tall ||
+				a.bounds.Max.X-b.bounds.Min.X > min(a.bounds.Dx(), b.bounds.Dx())/2 {
+				continue
+			}
+			aligned[i], aligned[j] = true, true
+		}
+	}
+	result := make([]textGlyph, 0, len(glyphs))
+	for i := range glyphs {
+		if aligned[i] {
+			result = append(result, glyphs[i])
+		}
+	}
+	return result
+}
+
+// Save the Region of a Sticker most likely to be Text as a PNG so moderators
+// can read it, nothing is written if no text was found. Animated stickers use
+// whichever frame scored highest.
+func TextCaption(id int, outputPath string) (TextEstimate, error) {
+	DatabaseMtx.RLock()
+	i, err := DatabaseFind(id)
+	var sticker DatabaseSticker
+	if err == nil {
+		sticker = Database.Stickers[i]
+	}
+	DatabaseMtx.RUnlock()
+	if err != nil {
+		return TextEstimate{}, err
+	}
+	data, err := os.ReadFile(path.Join(DATA_DIRECTORY, sticker.ImageHash))
+	if err != nil {
+		return TextEstimate{}, err
+	}
+	frames, err := ImageDecodeFrames(data, sticker.ImageType)
+	if err != nil {
+		return TextEstimate{}, err
+	}
+	var best TextEstimate
+	var frame image.Image
+	for _, f := range frames {
+		if est := ImageText(f); frame == nil || est.Score > best.Score {
+			best, frame = est, f
+		}
+	}
+	if best.Region.Empty() {
+		return best, nil
+	}
+
+	region := best.Region.Inset(-TEXT_CAPTION_MARGIN).Intersect(frame.Bounds())
+	caption := image.NewRGBA(image.Rect(0, 0, region.Dx(), region.Dy()))
+	draw.Draw(caption, caption.Rect, image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(caption, caption.Rect, frame, region.Min, draw.Over)
+	var b bytes.Buffer
+	if err := png.Encode(&b, caption); err != nil {
+		return TextEstimate{}, err
+	}
+	return best, WriteFileAtomic(outputPath, b.Bytes())
+}
@@ -0,0 +1,106 @@
+package env
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Render Lines of Text onto a w by h Canvas, enlarged by scale
+func testCaption(lines []string, w, h, scale int, fg, bg color.Color) *image.RGBA {
+	small := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(small, small.Rect, image.NewUniform(bg), image.Point{}, draw.Src)
+	d := font.Drawer{Dst: small, Src: image.NewUniform(fg), Face: basicfont.Face7x13}
+	for i, line := range lines {
+		d.Dot = fixed.P(10, 20+i*18)
+		d.DrawString(line)
+	}
+	big := image.NewRGBA(image.Rect(0, 0, w*scale, h*scale))
+	draw.NearestNeighbor.Scale(big, big.Rect, small, small.Rect, draw.Src, nil)
+	return big
+}
+
+// Random Pixels over the given Area of an Image
+func testNoise(img *image.RGBA, area image.Rectangle, seed int64) *image.RGBA {
+	r := rand.New(rand.NewSource(seed))
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			v := uint8(r.Intn(256))
+			img.SetRGBA(x, y, color.RGBA{v, uint8(r.Intn(256)), v, 255})
+		}
+	}
+	return img
+}
+
+func TestImageText(t *testing.T) {
+	threshold := float32(0.8) // Suggested text_threshold in the README
+	lines := []string{"when you finally fix the bug", "and three more appear", "in production on friday"}
+	red := color.RGBA{200, 0, 0, 255}
+	blank := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	draw.Draw(blank, blank.Rect, image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	for _, c := range []struct {
+		name     string
+		img      image.Image
+		min, max float32
+	}{
+		{"blank", blank, 0, 0},
+		{"transparent", image.NewRGBA(image.Rect(0, 0, 200, 200)), 0, 0},
+		{"caption", testCaption(lines, 400, 200, 1, color.Black, color.White), threshold, 1},
+		{"caption enlarged", testCaption(lines, 400, 200, 3, color.Black, color.White), threshold, 1},
+		{"light on dark", testCaption(lines, 260, 70, 2, color.White, red), threshold, 1},
+		{"transparent background", testCaption(lines, 260, 70, 2, color.Black, color.Transparent), threshold, 1},
+		{"noise", testNoise(image.NewRGBA(image.Rect(0, 0, 256, 256)), image.Rect(0, 0, 256, 256), 1), 0, 0.1},
+	} {
+		est := ImageText(c.img)
+		if est.Score < c.min || est.Score > c.max {
+			t.Errorf("%s: scored %.3f (%d glyphs, %.3f edges), want between %.2f and %.2f",
+				c.name, est.Score, est.Glyphs, est.Edges, c.min, c.max)
+		}
+	}
+}
+
+func TestImageTextTexturePenalized(t *testing.T) {
+	lines := []string{"when you finally fix the bug", "and three more appear", "in production on friday"}
+	clean := ImageText(testCaption(lines, 400, 200, 1, color.Black, color.White))
+
+	// The same caption beside a noisy texture is less of the image
+	noisy := testCaption(lines, 400, 200, 1, color.Black, color.White)
+	testNoise(noisy, image.Rect(0, 100, 400, 200), 2)
+	textured := ImageText(noisy)
+	if textured.Score >= clean.Score/2 {
+		t.Errorf("texture not penalized: scored %.3f, clean caption scored %.3f", textured.Score, clean.Score)
+	}
+	if textured.Region.Empty() || clean.Region.Empty() {
+		t.Errorf("caption region not found: %v and %v", textured.Region, clean.Region)
+	}
+}
+
+// Rows of narrow character-like marks filling a size by size canvas
+func testDense(size int) *image.RGBA {
+	dense := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(dense, dense.Rect, image.NewUniform(color.White), image.Point{}, draw.Src)
+	for y := 4; y+6 < size; y += 10 {
+		for x := 4; x+2 < size; x += 5 {
+			draw.Draw(dense, image.Rect(x, y, x+2, y+6), image.NewUniform(color.Black), image.Point{}, draw.Src)
+		}
+	}
+	return dense
+}
+
+func TestImageTextDense(t *testing.T) {
+	// More glyphs than are collected must score like the same text with fewer
+	few, many := ImageText(testDense(TEXT_SIZE/2)), ImageText(testDense(TEXT_SIZE))
+	if few.Glyphs >= TEXT_MAX_GLYPHS || many.Glyphs < TEXT_MAX_GLYPHS {
+		t.Fatalf("found %d and %d glyphs, want below and at %d", few.Glyphs, many.Glyphs, TEXT_MAX_GLYPHS)
+	}
+	if d := many.Score - few.Score; d < -0.05 || d > 0.05 {
+		t.Errorf("dense text scored %.3f, the same text with fewer glyphs scored %.3f", many.Score, few.Score)
+	}
+}
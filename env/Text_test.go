@@ -0,0 +1,55 @@
+package env
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTextFold(t *testing.T) {
+	for _, c := range []struct {
+		value, want string
+	}{
+		// Symbols before a letter
+		{"$ad", "sad"},
+		{"b@d", "bad"},
+		// Symbols after a letter, at the end of a word
+		{"a$$", "ass"},
+		{"ba$", "bas"},
+		{"be$t!", "besti"},
+		// Digits, accents and spacing
+		{"h3ll0", "hello"},
+		{"Bäd", "bad"},
+		{"b a d", "bad"},
+		// Punctuation standing alone is left alone
+		{"! $ @", ""},
+		{"what ?!", "what"},
+	} {
+		if got := TextFold(c.value); got != c.want {
+			t.Errorf("TextFold(%q) = %q, want %q", c.value, got, c.want)
+		}
+	}
+}
+
+func TestTextDenied(t *testing.T) {
+	c := configDefaults()
+	c.Moderation.DenyWords = []string{"ass", "bad"}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	previous := config.Load()
+	config.Store(&c)
+	defer config.Store(previous)
+
+	for _, value := range []string{"a$$", "@ss", "you a$$", "b@d", "so bad!", "bad!!", "b a d"} {
+		_, err := TextCheck("Message", value, 1024, false)
+		var te *TextError
+		if !errors.As(err, &te) {
+			t.Errorf("%q was not denied: %v", value, err)
+		}
+	}
+	for _, value := range []string{"glass", "badge", "bass!", "hello!", "a $ sign"} {
+		if _, err := TextCheck("Message", value, 1024, false); err != nil {
+			t.Errorf("%q was denied: %v", value, err)
+		}
+	}
+}
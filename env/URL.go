@@ -0,0 +1,77 @@
+package env
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Validate and Normalize a User URL, only http and https links to domains
+// permitted by the config file are accepted. Hostnames are converted to
+// punycode so lookalike characters are visible.
+func URLCheck(field, raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Opaque != "" {
+		return "", &TextError{Field: field, Reason: "must be a http or https link"}
+	}
+	if u.User != nil {
+		return "", &TextError{Field: field, Reason: "cannot contain a username or password"}
+	}
+
+	// Normalize Hostname
+	host, port := u.Hostname(), u.Port()
+	host, err = idna.Lookup.ToASCII(host)
+	if err != nil || host == "" {
+		return "", &TextError{Field: field, Reason: "has an invalid domain"}
+	}
+	if !URLDomainAllowed(host) {
+		return "", &TextError{Field: field, Reason: "links to a domain that is not allowed", Match: host}
+	}
+	u.Host = host
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	}
+
+	normalized := u.String()
+	if len(normalized) > Config().Limits.MaxURLBytes {
+		return "", &TextError{Field: field, Reason: "is too long"}
+	}
+	return normalized, nil
+}
+
+// Returns true if links to the given (punycode) hostname are permitted
+func URLDomainAllowed(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	c := Config()
+	for _, d := range c.Links.DenyDomains {
+		if urlDomainMatch(host, d) {
+			return false
+		}
+	}
+	if len(c.Links.AllowDomains) == 0 {
+		return true
+	}
+	for _, d := range c.Links.AllowDomains {
+		if urlDomainMatch(host, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Domains also match all of their subdomains
+func urlDomainMatch(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// Normalize a Domain from the config file for comparison
+func urlDomainNormalize(domain string) (string, error) {
+	domain = strings.TrimPrefix(strings.TrimPrefix(domain, "*"), ".")
+	domain, err := idna.Lookup.ToASCII(domain)
+	return strings.TrimSuffix(domain, "."), err
+}
@@ -1,9 +1,21 @@
 package env
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path"
 	"runtime"
 	"sync"
-	"sync/atomic"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
 )
 
 type ImageType string
@@ -43,42 +55,191 @@ func ImageSniffType(d []byte) ImageType {
 	}
 }
 
-// Easily spread a workload across all available threads, returning the error if any
-func Multithread(jobCount int, handler func(i int) error) error {
-	threads := runtime.NumCPU()
-	channel := make(chan int, jobCount)
+var ErrImageUnsupported = errors.New("unsupported image format")
+
+// Read the Dimensions of an Image without decoding it
+func ImageDecodeConfig(d []byte, t ImageType) (image.Config, error) {
+	switch t {
+	case IMAGE_WEBP:
+		return webp.DecodeConfig(bytes.NewReader(d))
+	case IMAGE_JPEG:
+		return jpeg.DecodeConfig(bytes.NewReader(d))
+	case IMAGE_PNG:
+		return png.DecodeConfig(bytes.NewReader(d))
+	case IMAGE_GIF:
+		return gif.DecodeConfig(bytes.NewReader(d))
+	default:
+		return image.Config{}, ErrImageUnsupported
+	}
+}
+
+// Decode every Frame of an Image, animated GIF frames are returned as-is without compositing
+func ImageDecodeFrames(d []byte, t ImageType) ([]image.Image, error) {
+	var still image.Image
+	var err error
+	switch t {
+	case IMAGE_WEBP:
+		still, err = webp.Decode(bytes.NewReader(d))
+	case IMAGE_JPEG:
+		still, err = jpeg.Decode(bytes.NewReader(d))
+	case IMAGE_PNG:
+		still, err = png.Decode(bytes.NewReader(d))
+	case IMAGE_GIF:
+		animated, err := gif.DecodeAll(bytes.NewReader(d))
+		if err != nil {
+			return nil, err
+		}
+		if len(animated.Image) == 0 {
+			return nil, errors.New("animation has no frames")
+		}
+		return ImageCompositeGIF(animated), nil
+	default:
+		return nil, ErrImageUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []image.Image{still}, nil
+}
+
+// Layer the Frames of an Animated GIF, each of which may only contain the
+// pixels which changed since the previous frame
+func ImageCompositeGIF(g *gif.GIF) []image.Image {
+	var (
+		frames    = make([]image.Image, len(g.Image))
+		imageBase = image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+		imagePrev = image.NewRGBA(imageBase.Bounds())
+	)
+	for i, frame := range g.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			copy(imagePrev.Pix, imageBase.Pix)
+		}
+
+		// Save Composited Frame
+		draw.Draw(imageBase, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		imageCopy := image.NewRGBA(imageBase.Bounds())
+		copy(imageCopy.Pix, imageBase.Pix)
+		frames[i] = imageCopy
+
+		// Dispose of the Frame before drawing the next one
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(imageBase, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(imageBase.Pix, imagePrev.Pix)
+		}
+	}
+	return frames
+}
+
+// Spread a workload across at most limit goroutines (all available threads if
+// limit is zero), every job is run unless the context is cancelled and the
+// errors of all failed jobs are returned together
+func Multithread(ctx context.Context, limit, jobCount int, handler func(ctx context.Context, i int) error) error {
+	if limit <= 0 {
+		limit = runtime.NumCPU()
+	}
+	channel := make(chan int)
 	var wait sync.WaitGroup
-	var fail atomic.Value
+	var failMtx sync.Mutex
+	var fails []error
 
 	// Startup Goroutines
-	for workerId := 0; workerId < threads; workerId++ {
+	for workerId := 0; workerId < min(limit, jobCount); workerId++ {
 		wait.Add(1)
 		go func() {
 			defer wait.Done()
 			for i := range channel {
-				// Exit early if an error has ocurred
-				if fail.Load() != nil {
-					return
-				}
 				// Run Handler and store it's error (if any)
-				if err := handler(i); err != nil {
-					fail.Store(err)
-					return
+				if err := handler(ctx, i); err != nil {
+					failMtx.Lock()
+					fails = append(fails, fmt.Errorf("job %d: %w", i, err))
+					failMtx.Unlock()
 				}
 			}
 		}()
 	}
 
-	// Queue and Complete Work Across all Threads
+	// Queue Work until Complete or Cancelled
+queue:
 	for i := 0; i < jobCount; i++ {
-		channel <- i
+		select {
+		case channel <- i:
+		case <-ctx.Done():
+			break queue
+		}
 	}
 	close(channel) // close or wait forever
 	wait.Wait()
 
-	// Return Error (if any)
-	if v := fail.Load(); v != nil {
-		return v.(error)
+	// Return Errors (if any)
+	if err := ctx.Err(); err != nil {
+		fails = append([]error{err}, fails...)
+	}
+	return errors.Join(fails...)
+}
+
+// A one-shot broadcast flag, any number of goroutines may wait for it to be raised
+type Signal struct {
+	once sync.Once
+	done chan struct{}
+}
+
+func NewSignal() *Signal {
+	return &Signal{done: make(chan struct{})}
+}
+
+// Raise the Signal releasing all waiting goroutines, safe to call more than once
+func (s *Signal) Set() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// Returns true if the Signal has been raised
+func (s *Signal) IsSet() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait for the Signal to be raised, returning false if the context ended first
+func (s *Signal) Wait(ctx context.Context) bool {
+	select {
+	case <-s.done:
+		return true
+	case <-ctx.Done():
+		return s.IsSet()
+	}
+}
+
+// Write a File within DATA_DIRECTORY by renaming a temporary file into place,
+// so readers never see it partially written and a crash or full disk leaves
+// the previous contents intact
+func WriteFileAtomic(filePath string, data []byte) error {
+	f, err := os.CreateTemp(path.Dir(filePath), TEMP_PREFIX+"write-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), FILE_MODE); err != nil {
+		return err
 	}
-	return nil
+	return os.Rename(f.Name(), filePath)
 }
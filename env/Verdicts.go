@@ -0,0 +1,228 @@
+package env
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Increment whenever the way images are prepared for or judged by the model
+// changes, so verdicts made under the previous rules are discarded
+const MODERATION_POLICY = 5
+
+// Verdicts kept for Images no Sticker uses, such as rejected uploads. Past
+// this the least recently used are discarded so uploading random images
+// cannot grow the cache without bound.
+const VERDICTS_UNUSED = 1024
+
+// Outcome of Classifying an Image, cached by it's file hash so the model only
+// ever sees an image once
+type Verdict struct {
+	Created time.Time     `json:"created"` // Image First Classified
+	Scores  []ModelScores `json:"scores"`  // Model Scores for each Frame
+	Safe    bool          `json:"safe"`    // Every Frame considered safe?
+	Model   string        `json:"model"`   // Model Version which made the Verdict
+	Policy  string        `json:"policy"`  // Policy Version the Verdict was judged under
+	Used    time.Time     `json:"used"`    // Verdict Last Looked Up
+}
+
+var (
+	verdictsMtx     sync.Mutex
+	verdicts        = make(map[string]Verdict)
+	verdictsPruneAt = VERDICTS_UNUSED // Size past which the Cache is next pruned
+	VerdictsPath    = path.Join(DATA_DIRECTORY, "verdicts.json")
+)
+
+// Returns the Current Policy Version, changing the threshold or backgrounds
+// also changes it as does enabling text estimates
+func VerdictPolicy() string {
+	m := Config().Moderation
+	policy := fmt.Sprintf("%d/%g/%s", MODERATION_POLICY, m.Threshold, strings.Join(m.Backgrounds, ","))
+	if m.TextThreshold > 0 {
+		policy += "/text"
+	}
+	return policy
+}
+
+func SetupVerdicts(stop context.Context, await *sync.WaitGroup) {
+	if err := VerdictsLoad(); err != nil {
+		slog.Warn("[verdicts] Cannot Load Verdicts, Starting Empty", "error", err)
+	}
+
+	// Shutdown Logic
+	await.Add(1)
+	go func() {
+		defer await.Done()
+		<-stop.Done()
+		if err := VerdictsSave(); err != nil {
+			slog.Error("[verdicts] Cannot Save Verdicts", "error", err)
+			return
+		}
+		slog.Info("[verdicts] Verdicts Saved")
+	}()
+}
+
+// Read Verdicts from Disk, discarding those made by another model or policy
+func VerdictsLoad() error {
+	b, err := os.ReadFile(VerdictsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var loaded map[string]Verdict
+	if err := json.Unmarshal(b, &loaded); err != nil {
+		return err
+	}
+	total := len(loaded)
+	referenced := verdictsReferenced()
+	verdictsMtx.Lock()
+	verdicts = loaded
+	verdictsPrune(referenced)
+	verdictsMtx.Unlock()
+	slog.Info("[verdicts] Verdicts Loaded", "verdicts", len(loaded), "discarded", total-len(loaded))
+	return nil
+}
+
+// Write Verdicts to Disk, discarding those that no longer apply
+func VerdictsSave() error {
+	referenced := verdictsReferenced()
+	verdictsMtx.Lock()
+	verdictsPrune(referenced)
+	b, err := json.Marshal(verdicts)
+	verdictsMtx.Unlock()
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(VerdictsPath, b)
+}
+
+// Retrieve the Verdict for an Image by it's file hash, verdicts made by a
+// different model or policy are ignored
+func VerdictLookup(hash string) (Verdict, bool) {
+	policy := VerdictPolicy()
+	verdictsMtx.Lock()
+	defer verdictsMtx.Unlock()
+	v, ok := verdicts[hash]
+	if !ok || v.Model != ModelVersion || v.Policy != policy {
+		return Verdict{}, false
+	}
+	v.Used = time.Now()
+	verdicts[hash] = v
+	return v, true
+}
+
+// Retrieve the Verdict for an Image, classifying it's frames if unknown
+func VerdictClassify(hash string, frames []image.Image) (Verdict, error) {
+	if v, ok := VerdictLookup(hash); ok {
+		return v, nil
+	}
+	estimateText := Config().Moderation.TextThreshold > 0
+	now := time.Now()
+	v := Verdict{
+		Created: now,
+		Used:    now,
+		Scores:  make([]ModelScores, len(frames)),
+		Safe:    true,
+		Model:   ModelVersion,
+		Policy:  VerdictPolicy(),
+	}
+	for i := range frames {
+		scores, err := ModelClassifyImage(frames[i])
+		if err != nil {
+			return Verdict{}, err
+		}
+		if estimateText {
+			scores.Text = ImageText(frames[i]).Score
+		}
+		v.Scores[i] = scores
+		v.Safe = v.Safe && scores.Safe()
+	}
+	verdictsMtx.Lock()
+	verdicts[hash] = v
+	full := len(verdicts) > verdictsPruneAt
+	verdictsMtx.Unlock()
+	if full {
+		referenced := verdictsReferenced()
+		verdictsMtx.Lock()
+		verdictsPrune(referenced)
+		verdictsMtx.Unlock()
+	}
+	return v, nil
+}
+
+// Returns the Image Hashes used by Stickers
+func verdictsReferenced() map[string]bool {
+	DatabaseMtx.RLock()
+	defer DatabaseMtx.RUnlock()
+	referenced := make(map[string]bool, len(Database.Stickers))
+	for _, s := range Database.Stickers {
+		referenced[s.ImageHash] = true
+	}
+	return referenced
+}
+
+// Discard Verdicts made by another model or policy, and all but the most
+// recently used VERDICTS_UNUSED for Images no Sticker uses. Must be called
+// with verdictsMtx held.
+func verdictsPrune(referenced map[string]bool) {
+	policy := VerdictPolicy()
+	unused := make([]string, 0)
+	for hash, v := range verdicts {
+		switch {
+		case v.Model != ModelVersion || v.Policy != policy:
+			delete(verdicts, hash)
+		case !referenced[hash]:
+			unused = append(unused, hash)
+		}
+	}
+	if len(unused) > VERDICTS_UNUSED {
+		slices.SortFunc(unused, func(a, b string) int { return verdicts[b].Used.Compare(verdicts[a].Used) })
+		for _, hash := range unused[VERDICTS_UNUSED:] {
+			delete(verdicts, hash)
+		}
+	}
+	verdictsPruneAt = len(verdicts) + VERDICTS_UNUSED
+}
+
+// Returns the First Frame considered inappropriate, or -1 if none are
+func (v Verdict) UnsafeFrame() int {
+	for i, s := range v.Scores {
+		if !s.Safe() {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the Scores of the most Inappropriate Frame alongside the highest
+// Text Estimate of any Frame
+func (v Verdict) Worst() ModelScores {
+	var worst ModelScores
+	for i, s := range v.Scores {
+		if i == 0 || s.Score() > worst.Score() {
+			worst = s
+		}
+	}
+	worst.Text = v.TextScore()
+	return worst
+}
+
+// Returns the Highest Text Estimate of any Frame
+func (v Verdict) TextScore() float32 {
+	var text float32
+	for _, s := range v.Scores {
+		text = max(text, s.Text)
+	}
+	return text
+}
@@ -0,0 +1,39 @@
+package env
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestVerdictsPrune(t *testing.T) {
+	verdictsMtx.Lock()
+	defer verdictsMtx.Unlock()
+	previous := verdicts
+	defer func() { verdicts = previous }()
+
+	// Unused verdicts past the limit are discarded oldest first, those for
+	// stickers and those made under another policy are kept and dropped
+	policy, start := VerdictPolicy(), time.Now()
+	verdicts = make(map[string]Verdict)
+	for i := 0; i < VERDICTS_UNUSED+10; i++ {
+		verdicts[fmt.Sprint("unused", i)] = Verdict{Model: ModelVersion, Policy: policy, Used: start.Add(time.Duration(i) * time.Second)}
+	}
+	verdicts["sticker"] = Verdict{Model: ModelVersion, Policy: policy}
+	verdicts["stale"] = Verdict{Model: ModelVersion, Policy: "0", Used: start.Add(time.Hour)}
+	verdictsPrune(map[string]bool{"sticker": true})
+
+	if len(verdicts) != VERDICTS_UNUSED+1 {
+		t.Errorf("kept %d verdicts, want %d", len(verdicts), VERDICTS_UNUSED+1)
+	}
+	for _, hash := range []string{"sticker", fmt.Sprint("unused", VERDICTS_UNUSED+9), "unused10"} {
+		if _, ok := verdicts[hash]; !ok {
+			t.Errorf("%s was discarded", hash)
+		}
+	}
+	for _, hash := range []string{"stale", "unused0", "unused9"} {
+		if _, ok := verdicts[hash]; ok {
+			t.Errorf("%s was kept", hash)
+		}
+	}
+}
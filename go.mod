@@ -3,9 +3,12 @@ module bakonpancakz/stickerboard
 go 1.23.4
 
 require (
+	github.com/BurntSushi/toml v1.5.0
 	github.com/galeone/tensorflow/tensorflow/go v0.0.0-20240119075110-6ad3cf65adfe
 	github.com/joho/godotenv v1.5.1
 	golang.org/x/image v0.27.0
+	golang.org/x/net v0.40.0
+	golang.org/x/text v0.25.0
 )
 
 require google.golang.org/protobuf v1.36.5 // indirect
@@ -2,7 +2,8 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -10,6 +11,7 @@ import (
 	"syscall"
 	"time"
 
+	"bakonpancakz/stickerboard/admin"
 	"bakonpancakz/stickerboard/env"
 	"bakonpancakz/stickerboard/routes"
 
@@ -17,13 +19,23 @@ import (
 )
 
 func main() {
+	// Run Admin Command (if any)
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		os.Exit(admin.Run(os.Args[1:]))
+	}
+
 	// Startup Services
 	var stopCtx, stop = context.WithCancel(context.Background())
 	var stopWg sync.WaitGroup
+	env.SetupConfig(stopCtx, &stopWg)
 	env.SetupDatabase(stopCtx, &stopWg)
+	env.SetupIntegrity(stopCtx, &stopWg)
 	env.SetupModel(stopCtx, &stopWg)
+	env.SetupVerdicts(stopCtx, &stopWg)
+	env.SetupRescan(stopCtx, &stopWg)
+	admin.SetupSocket(stopCtx, &stopWg)
+	env.SetupStickerboard(stopCtx, &stopWg)
 	go SetupHTTP(stopCtx, &stopWg)
-	go env.StickerboardRender()
 
 	// Await Shutdown Signal
 	cancel := make(chan os.Signal, 1)
@@ -37,11 +49,11 @@ func main() {
 	go func() {
 		<-timeout.Done()
 		if timeout.Err() == context.DeadlineExceeded {
-			log.Fatalln("[main] Cleanup timeout! Exiting now.")
+			env.LogFatal("[main] Cleanup timeout! Exiting now.")
 		}
 	}()
 	stopWg.Wait()
-	log.Println("[main] All done, bye bye!")
+	slog.Info("[main] All done, bye bye!")
 	os.Exit(0)
 }
 
@@ -50,10 +62,12 @@ func SetupHTTP(stop context.Context, await *sync.WaitGroup) {
 	r := http.NewServeMux()
 	r.HandleFunc("/", routes.GET_Index)
 	r.HandleFunc("/stickers", routes.POST_Stickers)
+	r.HandleFunc("PATCH /stickers/{id}", routes.PATCH_Stickers_ID)
+	r.HandleFunc("DELETE /stickers/{id}", routes.DELETE_Stickers_ID)
+	r.HandleFunc("/goto/{id}", routes.GET_Goto_ID)
 	r.HandleFunc("/assets/{filename}", routes.GET_Assets_Filename)
 	svr := http.Server{
-		Handler:           r,
-		Addr:              env.HTTP_ADDRESS,
+		Handler:           routes.Middleware(r),
 		TLSConfig:         env.HTTP_TLS,
 		MaxHeaderBytes:    4096,
 		IdleTimeout:       5 * time.Second,
@@ -62,25 +76,124 @@ func SetupHTTP(stop context.Context, await *sync.WaitGroup) {
 		ReadTimeout:       30 * time.Second,
 	}
 
+	// Gather Listeners, the website is served over every one of them
+	systemd, err := env.ListenSystemd()
+	if err != nil {
+		env.LogFatal("[http] Socket Activation Error", "error", err)
+	}
+	var public []Listener
+	if env.HTTP_ADDRESS != "" {
+		public = append(public, ListenTCP("public", env.HTTP_ADDRESS, env.TLS_ENABLED))
+	}
+	if env.HTTP_SOCKET != "" {
+		// Reverse Proxies on the same machine terminate TLS themselves
+		l, err := env.ListenUnix(env.HTTP_SOCKET, env.HTTP_SOCKET_MODE)
+		if err != nil {
+			env.LogFatal("[http] Listen Error", "server", "public", "error", err)
+		}
+		public = append(public, Listener{l, false})
+	}
+	for _, l := range systemd[env.LISTENER_PUBLIC] {
+		public = append(public, Listener{l, env.TLS_ENABLED})
+	}
+	if len(public) == 0 {
+		env.LogFatal("[http] No Listeners, set HTTP_ADDRESS or HTTP_SOCKET")
+	}
+
+	// Redirect Plain HTTP to HTTPS
+	var redirect []Listener
+	if env.HTTP_REDIRECT_ADDRESS != "" {
+		redirect = append(redirect, ListenTCP("redirect", env.HTTP_REDIRECT_ADDRESS, false))
+	}
+	for _, l := range systemd[env.LISTENER_REDIRECT] {
+		redirect = append(redirect, Listener{l, false})
+	}
+	if len(redirect) > 0 {
+		if !env.TLS_ENABLED {
+			slog.Warn("[http] Redirecting to HTTPS but TLS is not enabled, is a proxy terminating it?")
+		}
+		go ServeHTTP(stop, await, "redirect", &http.Server{
+			Handler:           http.HandlerFunc(routes.RedirectHTTPS),
+			MaxHeaderBytes:    4096,
+			IdleTimeout:       5 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      5 * time.Second,
+			ReadTimeout:       5 * time.Second,
+		}, redirect)
+	}
+
+	// Monitoring Endpoints are served alongside the website unless
+	// they have been given their own address
+	var admin []Listener
+	if env.HTTP_ADMIN_ADDRESS != "" {
+		admin = append(admin, ListenTCP("admin", env.HTTP_ADMIN_ADDRESS, false))
+	}
+	for _, l := range systemd[env.LISTENER_ADMIN] {
+		admin = append(admin, Listener{l, false})
+	}
+	if len(admin) == 0 {
+		SetupAdminRoutes(r)
+	} else {
+		a := http.NewServeMux()
+		SetupAdminRoutes(a)
+		go ServeHTTP(stop, await, "admin", &http.Server{
+			Handler:           routes.Middleware(a),
+			MaxHeaderBytes:    4096,
+			IdleTimeout:       5 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			ReadTimeout:       30 * time.Second,
+		}, admin)
+	}
+
+	ServeHTTP(stop, await, "public", &svr, public)
+}
+
+func SetupAdminRoutes(r *http.ServeMux) {
+	r.HandleFunc("/healthz", routes.GET_Healthz)
+	r.HandleFunc("/readyz", routes.GET_Readyz)
+	r.HandleFunc("/metrics", routes.GET_Metrics)
+}
+
+type Listener struct {
+	net.Listener
+	TLS bool // Serve HTTPS?
+}
+
+func ListenTCP(name, address string, useTLS bool) Listener {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		env.LogFatal("[http] Listen Error", "server", name, "error", err)
+	}
+	return Listener{l, useTLS}
+}
+
+func ServeHTTP(stop context.Context, await *sync.WaitGroup, name string, svr *http.Server, listeners []Listener) {
+
 	// Shutdown Logic
+	//	Closes every listener and waits for active requests to complete
 	await.Add(1)
 	go func() {
 		defer await.Done()
 		<-stop.Done()
 		svr.Shutdown(context.Background())
-		log.Println("[http] Cleaned up HTTP")
+		slog.Info("[http] Cleaned up HTTP", "server", name)
 	}()
 
 	// Server Startup
-	var err error
-	if env.TLS_ENABLED {
-		log.Printf("[http] Bound HTTPS - %s\n", svr.Addr)
-		err = svr.ListenAndServeTLS("", "")
-	} else {
-		log.Printf("[http] Bound HTTP - %s\n", svr.Addr)
-		err = svr.ListenAndServe()
-	}
-	if err != http.ErrServerClosed {
-		log.Fatalln("[http] Listen Error:", err)
+	for _, l := range listeners {
+		go func() {
+			var err error
+			if l.TLS {
+				slog.Info("[http] Bound HTTPS", "server", name, "address", l.Addr())
+				err = svr.ServeTLS(l, "", "")
+			} else {
+				slog.Info("[http] Bound HTTP", "server", name, "address", l.Addr())
+				err = svr.Serve(l)
+			}
+			if err != http.ErrServerClosed {
+				env.LogFatal("[http] Listen Error", "server", name, "error", err)
+			}
+		}()
 	}
 }
@@ -0,0 +1,9 @@
+package resources
+
+import "embed"
+
+// Website Templates and Public Assets bundled into the Executable,
+// the model is loaded from disk by Tensorflow and so is not included
+//
+//go:embed index.html goto.html public
+var Embedded embed.FS
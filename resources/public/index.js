@@ -17,8 +17,8 @@
     /** @param {string} s */
     const safe_url = s => {
         try {
-            new URL(s)
-            return true
+            const u = new URL(s)
+            return (u.protocol === "http:" || u.protocol === "https:") && !u.username && !u.password
         } catch (_) {
             return false
         }
@@ -210,9 +210,17 @@
             // Send Image
             formError.textContent = "Uploading, please wait..."
             const resp = await fetch("/stickers", { method: "POST", body: form })
-            if (resp.status !== 201) {
+            if (resp.status !== 201 && resp.status !== 202) {
                 throw `${resp.status}: ${await resp.text() || resp.statusText}`
             }
+            // Remember Edit Token so the sticker can be deleted later
+            const { id, edit_token, review } = await resp.json()
+            localStorage.setItem(`sticker-${id}`, edit_token)
+            if (review) {
+                formError.textContent = "Thanks! Your sticker will appear once it has been reviewed."
+                busy = false
+                return
+            }
             formError.textContent = "Done! Refreshing..."
             window.location.reload()
 
@@ -246,4 +254,29 @@
         })
     })
 
+    // Sticker Deletion (by it's Author)
+    document.querySelectorAll(".section-post").forEach(elem => {
+        const id = elem.getAttribute("data-id")
+        const token = localStorage.getItem(`sticker-${id}`)
+        if (!token) return
+        const button = document.createElement("button")
+        button.textContent = "Delete"
+        button.onclick = async () => {
+            if (!confirm("Delete this sticker?")) return
+            const resp = await fetch(`/stickers/${id}`, {
+                method: "DELETE",
+                headers: { "Authorization": `Bearer ${token}` },
+            })
+            if (resp.status === 204 || resp.status === 401 || resp.status === 403 || resp.status === 404) {
+                localStorage.removeItem(`sticker-${id}`)
+            }
+            if (resp.status !== 204) {
+                alert(`${resp.status}: ${await resp.text() || resp.statusText}`)
+                return
+            }
+            window.location.reload()
+        }
+        elem.appendChild(button)
+    })
+
 })()
\ No newline at end of file
@@ -0,0 +1,36 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+
+	"bakonpancakz/stickerboard/env"
+)
+
+func DELETE_Stickers_ID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Remove Sticker, it's image is left for the garbage collector
+	env.DatabaseMtx.Lock()
+	i, ok := findEditableSticker(w, r)
+	if !ok {
+		env.DatabaseMtx.Unlock()
+		return
+	}
+	id := env.Database.Stickers[i].ID
+	env.Database.Stickers = slices.Delete(env.Database.Stickers, i, i+1)
+	env.DatabaseVersion.Add(1)
+	env.DatabaseMtx.Unlock()
+	requestLogger(r).Info("[http] Sticker Deleted by Author", "id", id)
+
+	// Update Stickerboard
+	if _, err := env.StickerboardRender(r.Context()); err != nil && !errors.Is(err, context.Canceled) {
+		requestLogger(r).Error("[http] Render Error", "error", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,34 +1,48 @@
 package routes
 
 import (
+	"context"
+	"errors"
 	"io"
-	"log"
+	"io/fs"
 	"mime"
 	"net/http"
-	"os"
 	"path"
 	"time"
 
 	"bakonpancakz/stickerboard/env"
 )
 
-var pathPublic = path.Join("resources", "public")
+const (
+	STICKERBOARD_WAIT        = 5 * time.Second // Time to wait for the first render before giving up
+	STICKERBOARD_RETRY_AFTER = "5"             // Seconds the client should wait before retrying
+)
+
+const pathPublic = "public"
 
-// Serve Static File from Resource Directory
-func serveStaticFilename(w http.ResponseWriter, filepath string) {
+// Serve Static File from Resources
+func serveStaticFilename(w http.ResponseWriter, r *http.Request, filepath string) {
+	if !fs.ValidPath(filepath) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 
-	// Read File from Disk
-	f, err := os.Open(filepath)
+	// Read File from Theme or Embedded Resources
+	f, err := env.Resources.Open(filepath)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		log.Println("[http] Read Asset Error:", err)
+		requestLogger(r).Error("[http] Read Asset Error", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	defer f.Close()
+	if stat, err := f.Stat(); err != nil || stat.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 
 	// Determine Content-Type and Stream Contents
 	w.Header().Add("Content-Type", mime.TypeByExtension(path.Ext(filepath)))
@@ -44,13 +58,12 @@ func GET_Assets_Filename(w http.ResponseWriter, r *http.Request) {
 
 	if f == env.STICKERBOARD_FILENAME {
 		// Wait Until Stickerboard is Ready, this should only occur on startup!
-		if !env.StickerboardReady.Load() {
-			for {
-				if env.StickerboardReady.Load() {
-					break
-				}
-				time.Sleep(time.Second)
-			}
+		ctx, cancel := context.WithTimeout(r.Context(), STICKERBOARD_WAIT)
+		defer cancel()
+		if !env.StickerboardReady.Wait(ctx) {
+			w.Header().Set("Retry-After", STICKERBOARD_RETRY_AFTER)
+			http.Error(w, "Stickerboard is Rendering", http.StatusServiceUnavailable)
+			return
 		}
 		// Serve Stickerboard from Memory
 		env.StickerboardMtx.RLock()
@@ -61,5 +74,5 @@ func GET_Assets_Filename(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Serve Asset from Disk
-	serveStaticFilename(w, path.Join(pathPublic, f))
+	serveStaticFilename(w, r, path.Join(pathPublic, f))
 }
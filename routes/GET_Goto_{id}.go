@@ -0,0 +1,72 @@
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"bakonpancakz/stickerboard/env"
+)
+
+const GOTO_TEMPLATE = "goto.html" // Path to Interstitial Template within Resources
+
+type gotoData struct {
+	Sticker env.DatabaseSticker // Sticker being Visited
+	URL     string              // Normalized Destination
+	Host    string              // Destination Hostname (in punycode)
+}
+
+var gotoTemplate = templateCache{name: GOTO_TEMPLATE}
+
+// Warns visitors they are leaving the site before following an Author's link,
+// or sends them straight there when the interstitial is disabled
+func GET_Goto_ID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Find Visible Sticker
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	env.DatabaseMtx.RLock()
+	i, err := env.DatabaseFind(id)
+	var sticker env.DatabaseSticker
+	if err == nil {
+		sticker = env.Database.Stickers[i]
+	}
+	env.DatabaseMtx.RUnlock()
+	if err != nil || !sticker.Visible || sticker.UserURL == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Links are checked again in case the domain lists have changed
+	link, err := env.URLCheck("User URL", sticker.UserURL)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Add("Referrer-Policy", "no-referrer")
+	w.Header().Add("X-Robots-Tag", "noindex, nofollow")
+	if !env.Config().Links.Interstitial {
+		http.Redirect(w, r, link, http.StatusFound)
+		return
+	}
+
+	// Render Interstitial
+	tmpl, _, err := gotoTemplate.Load()
+	if err != nil {
+		requestLogger(r).Error("[http] Template Render Error", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	parsed, _ := url.Parse(link)
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	if err := tmpl.Execute(w, gotoData{Sticker: sticker, URL: link, Host: parsed.Hostname()}); err != nil {
+		requestLogger(r).Error("[http] Template Render Error", "error", err)
+	}
+}
@@ -0,0 +1,17 @@
+package routes
+
+import (
+	"net/http"
+)
+
+func GET_Healthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Process is alive if it can respond at all
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Add("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
@@ -2,40 +2,144 @@ package routes
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"fmt"
-	"html/template"
 	"net/http"
+	"slices"
+	"strconv"
+	"sync"
 
 	"bakonpancakz/stickerboard/env"
 )
 
+const (
+	INDEX_TEMPLATE  = "index.html" // Path to Index Template within Resources
+	INDEX_PAGE_SIZE = 50           // Stickers Listed per Page
+)
+
+type indexData struct {
+	Stickers []env.DatabaseSticker // Stickers on this Page
+	Page     int                   // Current Page
+	Pages    int                   // Total Pages
+	PrevPage int                   // Previous Page (0 if none)
+	NextPage int                   // Next Page (0 if none)
+}
+
+type indexPage struct {
+	Body []byte
+	ETag string
+}
+
+var (
+	indexMtx      sync.Mutex
+	indexTemplate = templateCache{name: INDEX_TEMPLATE}
+	indexVersion  uint64
+	indexConfig   uint64
+	indexCache    = make(map[int]indexPage)
+)
+
+// Render the requested Page, reusing the previous render if nothing has changed
+func indexRender(page int) (indexPage, bool, error) {
+	indexMtx.Lock()
+	defer indexMtx.Unlock()
+
+	tmpl, changed, err := indexTemplate.Load()
+	if err != nil {
+		return indexPage{}, false, err
+	}
+	if changed {
+		clear(indexCache)
+	}
+	if v := env.DatabaseVersion.Load(); v != indexVersion {
+		indexVersion = v
+		clear(indexCache)
+	}
+	if v := env.ConfigVersion.Load(); v != indexConfig {
+		indexConfig = v
+		clear(indexCache)
+	}
+	if cached, ok := indexCache[page]; ok {
+		return cached, true, nil
+	}
+
+	// Copy Visible Stickers, Newest First
+	// 	The template is executed without holding the lock to help protect
+	// 	the Database from Slowloris attacks
+	env.DatabaseMtx.RLock()
+	visible := make([]env.DatabaseSticker, 0, len(env.Database.Stickers))
+	for _, s := range env.Database.Stickers {
+		if s.Visible {
+			visible = append(visible, s)
+		}
+	}
+	env.DatabaseMtx.RUnlock()
+	slices.Reverse(visible)
+
+	// Paginate Stickers
+	data := indexData{
+		Page:  page,
+		Pages: max(1, (len(visible)+INDEX_PAGE_SIZE-1)/INDEX_PAGE_SIZE),
+	}
+	if page > data.Pages {
+		return indexPage{}, false, nil
+	}
+	if page > 1 {
+		data.PrevPage = page - 1
+	}
+	if page < data.Pages {
+		data.NextPage = page + 1
+	}
+	start := (page - 1) * INDEX_PAGE_SIZE
+	data.Stickers = visible[start:min(start+INDEX_PAGE_SIZE, len(visible))]
+
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, data); err != nil {
+		return indexPage{}, false, err
+	}
+	rendered := indexPage{
+		Body: body.Bytes(),
+		ETag: fmt.Sprintf(`"%x"`, sha1.Sum(body.Bytes())),
+	}
+	indexCache[page] = rendered
+	return rendered, true, nil
+}
+
 func GET_Index(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Parse and Render Template
-	// 	Rendered Document is stored in memory to help protect Database
-	// 	from Slowloris attacks
-	env.DatabaseMtx.RLock()
-	tmpl, err := template.ParseFiles("resources/index.html")
+	// Parse Page Number
+	page := 1
+	if v := r.URL.Query().Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		page = n
+	}
+
+	// Render Document
+	document, found, err := indexRender(page)
 	if err != nil {
-		fmt.Println("[http] Template Parse Error", err)
+		requestLogger(r).Error("[http] Template Render Error", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
-		env.DatabaseMtx.RUnlock()
 		return
 	}
-	var data bytes.Buffer
-	if err := tmpl.Execute(&data, env.Database.Stickers); err != nil {
-		fmt.Println("[http] Template Execute Error", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		env.DatabaseMtx.RUnlock()
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	env.DatabaseMtx.RUnlock()
 
 	// Send Document
+	w.Header().Add("ETag", document.ETag)
+	w.Header().Add("Cache-Control", "no-cache")
+	if r.Header.Get("If-None-Match") == document.ETag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 	w.Header().Add("Content-Type", "text/html; charset=utf-8")
-	w.Write(data.Bytes())
+	w.Write(document.Body)
 }
@@ -0,0 +1,17 @@
+package routes
+
+import (
+	"net/http"
+
+	"bakonpancakz/stickerboard/env"
+)
+
+func GET_Metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Add("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Add("Cache-Control", "no-store")
+	env.MetricsWrite(w)
+}
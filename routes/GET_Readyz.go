@@ -0,0 +1,41 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+
+	"bakonpancakz/stickerboard/env"
+)
+
+func GET_Readyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check all Services are Ready
+	checks := []struct {
+		Name   string
+		Signal *env.Signal
+	}{
+		{"model", env.ModelReady},
+		{"database", env.DatabaseReady},
+		{"stickerboard", env.StickerboardReady},
+	}
+	status := http.StatusOK
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Add("Cache-Control", "no-store")
+	for _, c := range checks {
+		if !c.Signal.IsSet() {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.WriteHeader(status)
+	for _, c := range checks {
+		state := "ok"
+		if !c.Signal.IsSet() {
+			state = "pending"
+		}
+		fmt.Fprintf(w, "%s: %s\n", c.Name, state)
+	}
+}
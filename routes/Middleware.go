@@ -0,0 +1,79 @@
+package routes
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type requestLoggerKey struct{}
+
+// Captures the Status Code and Size of a Response for Logging
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += n
+	return n, err
+}
+
+// Allows http.ResponseController to reach the underlying Writer
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// Tag every Request with a unique ID and log it once it has completed
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := time.Now()
+
+		// Generate Request ID
+		var b [8]byte
+		rand.Read(b[:])
+		id := hex.EncodeToString(b[:])
+		w.Header().Set("X-Request-ID", id)
+
+		// Attach Logger to Request
+		logger := slog.Default().With("request_id", id)
+		rr := &responseRecorder{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), requestLoggerKey{}, logger))
+		next.ServeHTTP(rr, r)
+
+		if rr.status == 0 {
+			rr.status = http.StatusOK
+		}
+		logger.Info("[http] Request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rr.status,
+			"bytes", rr.bytes,
+			"latency", time.Since(t),
+			"address", getRealAddress(r),
+		)
+	})
+}
+
+// Retrieve the Logger for a Request, including it's ID if available
+func requestLogger(r *http.Request) *slog.Logger {
+	if logger, ok := r.Context().Value(requestLoggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,183 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"bakonpancakz/stickerboard/env"
+)
+
+// Retrieve the Edit Token given to the Author when they posted
+func getEditToken(r *http.Request) string {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token
+}
+
+// Find the requested Sticker and check the Author may change it, responding
+// with an error if not. Must be called with env.DatabaseMtx held.
+func findEditableSticker(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return -1, false
+	}
+	i, err := env.DatabaseFind(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return -1, false
+	}
+	switch err := env.DatabaseEditAllowed(i, getEditToken(r)); {
+	case errors.Is(err, env.ErrEditDenied):
+		http.Error(w, "Invalid Edit Token", http.StatusUnauthorized)
+		return -1, false
+	case errors.Is(err, env.ErrEditExpired):
+		http.Error(w, "Sticker can no longer be changed", http.StatusForbidden)
+		return -1, false
+	}
+	return i, true
+}
+
+func PATCH_Stickers_ID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if _, banned := env.DatabaseBanned(getRealAddress(r)); banned {
+		http.Error(w, "Banned", http.StatusForbidden)
+		return
+	}
+
+	// Parse Incoming JSON, omitted fields are left unchanged
+	var editJSON struct {
+		OffsetX    *int    `json:"offset_x"`
+		OffsetY    *int    `json:"offset_y"`
+		ImageScale *int    `json:"image_scale"`
+		UserURL    *string `json:"user_url"`
+		Message    *string `json:"message"`
+	}
+	limits := env.Config().Limits
+	r.Body = http.MaxBytesReader(w, r.Body, int64(limits.MaxMessageBytes)+4096)
+	if err := json.NewDecoder(r.Body).Decode(&editJSON); err != nil {
+		http.Error(w, "Malformed Body", http.StatusBadRequest)
+		return
+	}
+	editSticker := func(s *env.DatabaseSticker) {
+		if editJSON.OffsetX != nil {
+			s.OffsetX = *editJSON.OffsetX
+		}
+		if editJSON.OffsetY != nil {
+			s.OffsetY = *editJSON.OffsetY
+		}
+		if editJSON.ImageScale != nil {
+			s.ImageScale = float64(*editJSON.ImageScale) / 100
+		}
+		if editJSON.UserURL != nil {
+			s.UserURL = *editJSON.UserURL
+		}
+		if editJSON.Message != nil {
+			s.Message = *editJSON.Message
+		}
+	}
+
+	// The Author is checked first so strangers cannot probe text moderation
+	// or run the model against any sticker
+	env.DatabaseMtx.RLock()
+	i, ok := findEditableSticker(w, r)
+	var before env.DatabaseSticker
+	if ok {
+		before = env.Database.Stickers[i]
+	}
+	env.DatabaseMtx.RUnlock()
+	if !ok {
+		return
+	}
+
+	// Moderate Text without holding the database lock, as it may be slow
+	if editJSON.UserURL != nil && (moderateText(w, r, "User URL", editJSON.UserURL, limits.MaxURLBytes, false) != nil ||
+		moderateURL(w, r, "User URL", editJSON.UserURL) != nil) {
+		return
+	}
+	if editJSON.Message != nil && moderateText(w, r, "Message", editJSON.Message, limits.MaxMessageBytes, true) != nil {
+		return
+	}
+
+	// Moved Stickers are classified in their new position like new uploads,
+	// which is too slow to do while holding the database lock
+	classified := false
+	review := ""
+	var reviewScores env.ModelScores
+	moved := editJSON.OffsetX != nil || editJSON.OffsetY != nil || editJSON.ImageScale != nil
+	if mode := env.Config().Moderation.Composite; moved && mode != env.COMPOSITE_OFF {
+		classified = true
+		s := before
+		editSticker(&s)
+		if err := env.StickerboardValidateSticker(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.Visible {
+			scores, region, err := env.CompositeClassifyStored(s)
+			if err != nil {
+				requestLogger(r).Error("[http] Cannot Classify Composite", "error", err)
+				http.Error(w, "Model Error", http.StatusInternalServerError)
+				return
+			}
+			if !scores.Safe() {
+				requestLogger(r).Warn("[http] Inappropriate Composite",
+					"address", getRealAddress(r), "id", s.ID, "region", region, "action", mode, "scores", scores)
+				if mode == env.COMPOSITE_REJECT {
+					http.Error(w, "Sticker would be Inappropriate in this Position", http.StatusBadRequest)
+					return
+				}
+				review = fmt.Sprintf("review: composite scored %.2f", scores.Score())
+				reviewScores = scores
+			}
+		}
+	}
+
+	// Validate and Apply Changes together so no other edit can slip between,
+	// the sticker may have been deleted or the edit window passed meanwhile
+	env.DatabaseMtx.Lock()
+	i, ok = findEditableSticker(w, r)
+	if !ok {
+		env.DatabaseMtx.Unlock()
+		return
+	}
+	s := env.Database.Stickers[i]
+	if classified && (s.OffsetX != before.OffsetX || s.OffsetY != before.OffsetY ||
+		s.ImageScale != before.ImageScale || s.Visible != before.Visible) {
+		env.DatabaseMtx.Unlock()
+		http.Error(w, "Sticker was changed by another request, try again", http.StatusConflict)
+		return
+	}
+	editSticker(&s)
+	if err := env.StickerboardValidateSticker(s); err != nil {
+		env.DatabaseMtx.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if review != "" {
+		s.Visible = false
+		s.Flagged = review
+		s.FlagScores = &reviewScores
+	}
+	env.Database.Stickers[i] = s
+	env.DatabaseVersion.Add(1)
+	env.DatabaseMtx.Unlock()
+	requestLogger(r).Info("[http] Sticker Edited by Author", "id", s.ID, "review", review != "")
+
+	// Update Stickerboard
+	if _, err := env.StickerboardRender(r.Context()); err != nil && !errors.Is(err, context.Canceled) {
+		requestLogger(r).Error("[http] Render Error", "error", err)
+	}
+	if review != "" {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
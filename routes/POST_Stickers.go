@@ -2,26 +2,54 @@ package routes
 
 import (
 	"bakonpancakz/stickerboard/env"
-	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"image"
-	"image/gif"
-	"image/jpeg"
-	"image/png"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"os"
 	"path"
 	"sync"
 	"time"
-
-	"golang.org/x/image/webp"
 )
 
+// Sanitize and Moderate a Text Field in place, responding with an error and
+// returning it if the field was refused
+func moderateText(w http.ResponseWriter, r *http.Request, field string, value *string, maxBytes int, multiline bool) *env.TextError {
+	clean, err := env.TextCheck(field, *value, maxBytes, multiline)
+	if err != nil {
+		textErr := err.(*env.TextError)
+		if textErr.Match != "" {
+			requestLogger(r).Warn("[http] Text Denied",
+				"address", getRealAddress(r), "field", field, "rule", textErr.Match, "value", *value)
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return textErr
+	}
+	*value = clean
+	return nil
+}
+
+// Validate and Normalize a Link in place, responding with an error and
+// returning it if the link was refused
+func moderateURL(w http.ResponseWriter, r *http.Request, field string, value *string) *env.TextError {
+	clean, err := env.URLCheck(field, *value)
+	if err != nil {
+		textErr := err.(*env.TextError)
+		if textErr.Match != "" {
+			requestLogger(r).Warn("[http] Link Denied",
+				"address", getRealAddress(r), "field", field, "domain", textErr.Match, "value", *value)
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return textErr
+	}
+	*value = clean
+	return nil
+}
+
 // Dead Simple Ratelimiting, refreshes whenever it feels like...
 var uploadDebounce sync.Map
 
@@ -57,10 +85,15 @@ func POST_Stickers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Record Outcome for Metrics
+	uploadOutcome := env.UPLOAD_INVALID
+	defer func() { env.MetricUploads.Inc(uploadOutcome) }()
+
 	// Rate Limiting
 	uploadOK := false
 	uploadIP := getRealAddress(r)
 	if _, exists := uploadDebounce.Load(uploadIP); exists {
+		uploadOutcome = env.UPLOAD_RATE_LIMITED
 		http.Error(w, "Posted Too Recently", http.StatusTooManyRequests)
 		return
 	}
@@ -70,14 +103,28 @@ func POST_Stickers(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 	uploadDebounce.Store(uploadIP, true)
+	if ban, banned := env.DatabaseBanned(uploadIP); banned {
+		requestLogger(r).Info("[http] Banned Address Attempted Upload", "address", uploadIP, "cidr", ban.CIDR)
+		uploadOutcome = env.UPLOAD_BANNED
+		http.Error(w, "Banned", http.StatusForbidden)
+		return
+	}
 
 	// Sanity Checks
-	r.Body = http.MaxBytesReader(w, r.Body, env.MAX_FORM_BYTES)
-	if r.ContentLength > env.MAX_FORM_BYTES {
+	limits := env.Config().Limits
+	r.Body = http.MaxBytesReader(w, r.Body, limits.MaxUploadBytes)
+	if r.ContentLength > limits.MaxUploadBytes {
+		uploadOutcome = env.UPLOAD_TOO_LARGE
 		http.Error(w, "Payload Too Large", http.StatusRequestEntityTooLarge)
 		return
 	}
-	if err := r.ParseMultipartForm(env.MAX_FORM_BYTES); err != nil {
+	if err := r.ParseMultipartForm(limits.MaxUploadBytes); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			uploadOutcome = env.UPLOAD_TOO_LARGE
+			http.Error(w, "Payload Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Invalid Form Body", http.StatusBadRequest)
 		return
 	}
@@ -95,11 +142,36 @@ func POST_Stickers(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Malformed Form Data", http.StatusBadRequest)
 		return
 	}
-	if formJSON.ImageScale < 1 || formJSON.ImageScale > 100 || len(formJSON.Message) > 1024 {
+	if formJSON.ImageScale < 1 || formJSON.ImageScale > 100 {
 		http.Error(w, "Invalid Form Body", http.StatusBadRequest)
 		return
 	}
 
+	// Moderate Text
+	for _, f := range []struct {
+		Name      string
+		Value     *string
+		MaxBytes  int
+		Multiline bool
+	}{
+		{"User Name", &formJSON.UserName, limits.MaxNameBytes, false},
+		{"User URL", &formJSON.UserURL, limits.MaxURLBytes, false},
+		{"Message", &formJSON.Message, limits.MaxMessageBytes, true},
+	} {
+		if err := moderateText(w, r, f.Name, f.Value, f.MaxBytes, f.Multiline); err != nil {
+			if err.Match != "" {
+				uploadOutcome = env.UPLOAD_TEXT_DENIED
+			}
+			return
+		}
+	}
+	if err := moderateURL(w, r, "User URL", &formJSON.UserURL); err != nil {
+		if err.Match != "" {
+			uploadOutcome = env.UPLOAD_TEXT_DENIED
+		}
+		return
+	}
+
 	// Copy Incoming Image to Memory
 	// 	We're might partially or fully read it multiple times, so yes it has to
 	// 	be stored entirely in memory (@_@)
@@ -117,109 +189,103 @@ func POST_Stickers(w http.ResponseWriter, r *http.Request) {
 
 	// Validate Incoming Image
 	var imageType = env.ImageSniffType(formImage)
-	var imageInfo image.Config
-	var imageErr error
-
-	switch imageType {
-	case env.IMAGE_WEBP:
-		imageInfo, imageErr = webp.DecodeConfig(bytes.NewReader(formImage))
-	case env.IMAGE_JPEG:
-		imageInfo, imageErr = jpeg.DecodeConfig(bytes.NewReader(formImage))
-	case env.IMAGE_PNG:
-		imageInfo, imageErr = png.DecodeConfig(bytes.NewReader(formImage))
-	case env.IMAGE_GIF:
-		imageInfo, imageErr = gif.DecodeConfig(bytes.NewReader(formImage))
-	default:
+	imageInfo, imageErr := env.ImageDecodeConfig(formImage, imageType)
+	if errors.Is(imageErr, env.ErrImageUnsupported) {
+		uploadOutcome = env.UPLOAD_BAD_FORMAT
 		http.Error(w, "Unsupported Image Format", http.StatusBadRequest)
 		return
 	}
 	if imageErr != nil {
+		uploadOutcome = env.UPLOAD_BAD_FORMAT
 		http.Error(w, "Invalid Image Data", http.StatusBadRequest)
 		return
 	}
-	if imageInfo.Height > 2048 || imageInfo.Width > 2048 {
-		http.Error(w, "Image dimension cannot be larger than 2048 pixels", http.StatusBadRequest)
+	if imageInfo.Height > limits.MaxDimension || imageInfo.Width > limits.MaxDimension {
+		uploadOutcome = env.UPLOAD_TOO_LARGE
+		http.Error(w, fmt.Sprintf("Image dimension cannot be larger than %d pixels", limits.MaxDimension), http.StatusBadRequest)
 		return
 	}
-	if imageInfo.Height < 32 || imageInfo.Width < 32 {
-		http.Error(w, "Image dimension cannot be smaller than 32 pixels", http.StatusBadRequest)
+	if imageInfo.Height < limits.MinDimension || imageInfo.Width < limits.MinDimension {
+		uploadOutcome = env.UPLOAD_TOO_SMALL
+		http.Error(w, fmt.Sprintf("Image dimension cannot be smaller than %d pixels", limits.MinDimension), http.StatusBadRequest)
 		return
 	}
 
 	// Validate Image Placement
-	scaledFloat := float32(formJSON.ImageScale) / 100
-	scaledWidth := int((float32(imageInfo.Width) * scaledFloat))
-	scaledHeight := int((float32(imageInfo.Height) * scaledFloat))
-	if scaledHeight > (env.CANVAS_STICKER_MAX_HEIGHT + 4) {
-		http.Error(w, "Image is Too Large", http.StatusBadRequest)
-		return
-	}
-	if formJSON.OffsetX < -scaledWidth || formJSON.OffsetX > env.CANVAS_WIDTH ||
-		formJSON.OffsetY < -scaledHeight || formJSON.OffsetY > env.CANVAS_HEIGHT {
-		http.Error(w, "Image cannot be placed off-screen", http.StatusBadRequest)
-		return
-	}
-
-	// Decode Image Frame(s) for Classification
-	var imageFrames = make([]image.Image, 0, 1)
-	var decodedStill image.Image
-	var decodedFrame *gif.GIF
-
-	switch imageType {
-	case env.IMAGE_WEBP:
-		decodedStill, imageErr = webp.Decode(bytes.NewReader(formImage))
-	case env.IMAGE_JPEG:
-		decodedStill, imageErr = jpeg.Decode(bytes.NewReader(formImage))
-	case env.IMAGE_PNG:
-		decodedStill, imageErr = png.Decode(bytes.NewReader(formImage))
-	case env.IMAGE_GIF:
-		decodedFrame, imageErr = gif.DecodeAll(bytes.NewReader(formImage))
-	default:
-		log.Printf("[http] Missing Decoder for Image Type: %s\n", imageType)
-		http.Error(w, "Unsupported Image Format", http.StatusBadRequest)
+	err := env.StickerboardValidatePlacement(imageInfo.Width, imageInfo.Height, formJSON.ImageScale, formJSON.OffsetX, formJSON.OffsetY)
+	if err != nil {
+		if err == env.ErrStickerTooLarge {
+			uploadOutcome = env.UPLOAD_TOO_LARGE
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if imageErr != nil {
-		http.Error(w, "Invalid Image Data", http.StatusBadRequest)
+
+	// Limit how often the same Image appears on the Board, this is checked
+	// again when the sticker is added as other uploads may finish first
+	imageHash := fmt.Sprintf("%X", sha1.Sum(formImage))
+	env.DatabaseMtx.RLock()
+	duplicate := limits.MaxDuplicates > 0 && env.DatabaseCountImage(imageHash) >= limits.MaxDuplicates
+	env.DatabaseMtx.RUnlock()
+	if duplicate {
+		uploadOutcome = env.UPLOAD_DUPLICATE
+		http.Error(w, "Image already appears on the board too many times", http.StatusConflict)
 		return
-	} else {
-		// Copy Decoded Frames
-		if imageType == env.IMAGE_GIF {
-			for i := range decodedFrame.Image {
-				frame := decodedFrame.Image[i]
-				imageFrames = append(imageFrames, frame.SubImage(frame.Rect))
-			}
-		} else {
-			imageFrames = append(imageFrames, decodedStill)
-			decodedStill = nil
-		}
 	}
 
-	// Classify Decoded Frames
-	for i := range imageFrames {
-		pass, err := env.ModelClassifyImage(imageFrames[i])
-		if err != nil {
-			log.Println("[http] Cannot Classify Image:", err)
-			http.Error(w, "Model Error", http.StatusInternalServerError)
+	// Images already known to be inappropriate are refused immediately
+	if verdict, known := env.VerdictLookup(imageHash); known && !verdict.Safe {
+		requestLogger(r).Warn("[http] Inappropriate Image Uploaded",
+			"address", uploadIP, "frame", verdict.UnsafeFrame(), "cached", true)
+		uploadOutcome = env.UPLOAD_REJECTED
+		http.Error(w, "Inappropriate Image", http.StatusBadRequest)
+		return
+	}
+
+	// Decode Image Frame(s) for Classification, reusing the work done for
+	// an identical upload if possible
+	imageWork, imageCached := env.ImageCacheGet(imageHash)
+	if !imageCached {
+		imageFrames, imageErr := env.ImageDecodeFrames(formImage, imageType)
+		if imageErr != nil {
+			uploadOutcome = env.UPLOAD_BAD_FORMAT
+			http.Error(w, "Invalid Image Data", http.StatusBadRequest)
 			return
 		}
-		if !pass {
-			log.Printf("[http] Inappopriate Image Uploaded by %s\n", uploadIP)
-			http.Error(w, "Inappropriate Image", http.StatusBadRequest)
-			return
+		imageWork = &env.ImageCacheEntry{
+			Frames: imageFrames,
+			Hashes: env.ImagePerceptualHashes(imageFrames),
 		}
+		env.ImageCachePut(imageHash, imageWork)
 	}
 
-	// Write Contents to Disk
-	imageHash := fmt.Sprintf("%X", sha1.Sum(formImage))
-	imagePath := path.Join(env.DATA_DIRECTORY, imageHash)
-	if err := os.WriteFile(imagePath, formImage, env.FILE_MODE); err != nil {
-		log.Println("[http] Cannot Write Image:", imagePath, err)
+	// Refuse Images similar to those Removed as Abusive
+	if block, blocked := env.BlocklistMatch(imageWork.Hashes); blocked {
+		requestLogger(r).Warn("[http] Blocked Image Uploaded",
+			"address", uploadIP, "hash", block.Hash, "sticker", block.StickerID)
+		uploadOutcome = env.UPLOAD_BLOCKED
+		http.Error(w, "Image has been Removed Previously", http.StatusBadRequest)
 		return
 	}
-	// Write Contents to Database
-	env.DatabaseMtx.Lock()
-	env.Database.Stickers = append(env.Database.Stickers, env.DatabaseSticker{
+
+	// Classify Decoded Frames, known images skip the model entirely
+	verdict, err := env.VerdictClassify(imageHash, imageWork.Frames)
+	if err != nil {
+		requestLogger(r).Error("[http] Cannot Classify Image", "error", err)
+		uploadOutcome = env.UPLOAD_ERROR
+		http.Error(w, "Model Error", http.StatusInternalServerError)
+		return
+	}
+	if !verdict.Safe {
+		i := verdict.UnsafeFrame()
+		requestLogger(r).Warn("[http] Inappropriate Image Uploaded",
+			"address", uploadIP, "frame", i, "scores", verdict.Scores[max(i, 0)])
+		uploadOutcome = env.UPLOAD_REJECTED
+		http.Error(w, "Inappropriate Image", http.StatusBadRequest)
+		return
+	}
+	editToken, editHash := env.DatabaseEditToken()
+	sticker := env.DatabaseSticker{
 		Created:     time.Now(),
 		UserAddress: uploadIP,
 		UserName:    formJSON.UserName,
@@ -233,11 +299,97 @@ func POST_Stickers(w http.ResponseWriter, r *http.Request) {
 		ImageWidth:  imageInfo.Width,
 		ImageType:   imageType,
 		ImageHash:   imageHash,
-	})
+		EditToken:   editHash,
+		ImageHashes: imageWork.Hashes,
+	}
+
+	// Classify the Board around the Sticker as it would appear once placed
+	if mode := env.Config().Moderation.Composite; mode != env.COMPOSITE_OFF {
+		scores, region, err := env.CompositeClassify(sticker, imageWork.Frames[0])
+		if err != nil {
+			requestLogger(r).Error("[http] Cannot Classify Composite", "error", err)
+			uploadOutcome = env.UPLOAD_ERROR
+			http.Error(w, "Model Error", http.StatusInternalServerError)
+			return
+		}
+		if !scores.Safe() {
+			requestLogger(r).Warn("[http] Inappropriate Composite",
+				"address", uploadIP, "region", region, "action", mode, "scores", scores)
+			if mode == env.COMPOSITE_REJECT {
+				uploadOutcome = env.UPLOAD_REJECTED
+				http.Error(w, "Sticker would be Inappropriate in this Position", http.StatusBadRequest)
+				return
+			}
+			sticker.Visible = false
+			sticker.Flagged = fmt.Sprintf("review: composite scored %.2f", scores.Score())
+			scores.Text = verdict.TextScore()
+			sticker.FlagScores = &scores
+		}
+	}
+
+	// Hold Stickers which are mostly Text for review, as the model cannot read
+	if t := env.Config().Moderation.TextThreshold; t > 0 && sticker.Visible {
+		if text := verdict.TextScore(); float64(text) >= t {
+			requestLogger(r).Info("[http] Text Image Uploaded", "address", uploadIP, "text", text)
+			sticker.Visible = false
+			sticker.Flagged = fmt.Sprintf("review: text scored %.2f", text)
+			worst := verdict.Worst()
+			sticker.FlagScores = &worst
+		}
+	}
+
+	// Write Contents to Disk, identical images share the same file. A reused
+	// file is touched under the lock so the orphan collector, which removes
+	// files while holding it, cannot delete it before the sticker is stored
+	imagePath := path.Join(env.DATA_DIRECTORY, imageHash)
+	env.DatabaseMtx.RLock()
+	reused := false
+	if stat, err := os.Stat(imagePath); err == nil && stat.Size() == int64(len(formImage)) {
+		now := time.Now()
+		reused = os.Chtimes(imagePath, now, now) == nil
+	}
+	env.DatabaseMtx.RUnlock()
+	if !reused {
+		if err := env.WriteFileAtomic(imagePath, formImage); err != nil {
+			requestLogger(r).Error("[http] Cannot Write Image", "path", imagePath, "error", err)
+			uploadOutcome = env.UPLOAD_ERROR
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	// Write Contents to Database
+	env.DatabaseMtx.Lock()
+	if n := limits.MaxDuplicates; n > 0 && env.DatabaseCountImage(imageHash) >= n {
+		env.DatabaseMtx.Unlock()
+		uploadOutcome = env.UPLOAD_DUPLICATE
+		http.Error(w, "Image already appears on the board too many times", http.StatusConflict)
+		return
+	}
+	sticker.ID = env.DatabaseNextID()
+	env.Database.Stickers = append(env.Database.Stickers, sticker)
+	env.DatabaseVersion.Add(1)
 	env.DatabaseMtx.Unlock()
 	uploadOK = true
 
-	// Update Stickerboard
-	env.StickerboardRender()
-	w.WriteHeader(http.StatusCreated)
+	// Update Stickerboard, stickers held for review are not shown until approved
+	status := http.StatusCreated
+	if sticker.Visible {
+		uploadOutcome = env.UPLOAD_ACCEPTED
+		if _, err := env.StickerboardRender(r.Context()); err != nil && !errors.Is(err, context.Canceled) {
+			requestLogger(r).Error("[http] Render Error", "error", err)
+		}
+	} else {
+		uploadOutcome = env.UPLOAD_REVIEW
+		status = http.StatusAccepted
+	}
+
+	// The Edit Token is only ever shown to the Author here
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":         sticker.ID,
+		"edit_token": editToken,
+		"review":     !sticker.Visible,
+	})
 }
@@ -0,0 +1,20 @@
+package routes
+
+import (
+	"net"
+	"net/http"
+
+	"bakonpancakz/stickerboard/env"
+)
+
+// Redirect Plain HTTP Requests to the same URL over HTTPS
+func RedirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(env.HTTP_ADDRESS); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
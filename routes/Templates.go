@@ -0,0 +1,68 @@
+package routes
+
+import (
+	"html/template"
+	"io/fs"
+	"strconv"
+	"sync"
+	"time"
+
+	"bakonpancakz/stickerboard/env"
+)
+
+// Functions available to every Template
+var templateFuncs = template.FuncMap{
+	"link": stickerLink,
+}
+
+// A Template parsed from Resources once, or again if the theme directory was
+// changed or it's file modified while TEMPLATE_RELOAD is enabled
+type templateCache struct {
+	mtx      sync.Mutex
+	name     string // Path to Template within Resources
+	tmpl     *template.Template
+	modified time.Time
+	theme    uint64
+}
+
+// Returns the Parsed Template and whether it changed since the last call
+func (c *templateCache) Load() (*template.Template, bool, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	theme := env.ResourcesVersion.Load()
+	if c.tmpl != nil && c.theme == theme && !env.TEMPLATE_RELOAD {
+		return c.tmpl, false, nil
+	}
+	stat, err := fs.Stat(env.Resources, c.name)
+	if err != nil {
+		return nil, false, err
+	}
+	if c.tmpl != nil && c.theme == theme && stat.ModTime().Equal(c.modified) {
+		return c.tmpl, false, nil
+	}
+	tmpl, err := template.New(c.name).Funcs(templateFuncs).ParseFS(env.Resources, c.name)
+	if err != nil {
+		return nil, false, err
+	}
+	c.tmpl = tmpl
+	c.modified = stat.ModTime()
+	c.theme = theme
+	return tmpl, true, nil
+}
+
+// Returns where the Sticker Author's name should link to, or an empty string
+// if their link is missing or no longer permitted
+func stickerLink(s env.DatabaseSticker) string {
+	if s.UserURL == "" {
+		return ""
+	}
+	link, err := env.URLCheck("User URL", s.UserURL)
+	if err != nil {
+		return ""
+	}
+	if env.Config().Links.Interstitial {
+		return "/goto/" + strconv.Itoa(s.ID)
+	}
+	return link
+}